@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"encoding/json"
+	"runtime"
 	"sync"
 	"github.com/op/go-logging"
 	Log "github.com/Catofes/go-its/log"
@@ -10,20 +11,103 @@ import (
 
 var log *logging.Logger
 
+// ProbeTarget is a service monitored besides the peers. Type is one of udp,
+// tcp, http, dns or icmp. Address is host:port, or only the host for icmp.
+// Http targets are checked for Status and, if set, Body in the response,
+// dns targets resolve Query on the server at Address.
+type ProbeTarget struct {
+	Name    string
+	Type    string
+	Address string
+	Url     string
+	Status  int
+	Body    string
+	Query   string
+	Timeout uint64
+}
+
+// NodeAddress is where a center or peer listens. WebAddress is the host:port
+// of the web server of a center.
+type NodeAddress struct {
+	Address    string
+	Port       uint16
+	WebAddress string
+}
+
+// Centers are all centers, clients sync with each of them. On a center
+// CenterServerAddress and ListenPort are its own address, the other centers
+// elect a leader with it, which alone drives the gateway. A leader needs a
+// majority of the Centers, so only three or more survive losing one. Without
+// Centers a client syncs with CenterServerAddress and CenterServerPort, and a
+// center is the only one.
+//
+// With Gossip set every node also sends its peer list to GossipFanout random
+// peers each sync, and asks as many to probe peers which went silent, so
+// peers and their state spread without a center. Seeds are peers to start
+// with.
+//
+// Streams carry packages over tcp for clients which can't use udp. A node
+// only accepts them over the transports in Streams, "tcp" on ListenPort and,
+// on centers, "websocket" on the web server. A client falls back to its
+// Fallback transport when a center stays silent over udp, over websocket to
+// the WebAddress of the center.
+//
+// The web server manages the credentials in CredentialFile only for requests
+// with the header "Authorization: Bearer <AdminToken>", and not at all
+// without an AdminToken.
+//
+// Times are in milliseconds, except SessionTimeout, the lifetime of a gateway
+// session in hours as the gateway takes it. The session is refreshed
+// SessionRefresh milliseconds before it expires.
 type MainConfig struct {
 	ListenAddress       string
 	ListenPort          uint16
+	ListenNetwork       string
+	Streams             []string
+	Fallback            string
 	CenterServerAddress string
 	CenterServerPort    uint16
+	Centers             []NodeAddress
+	LeaseTime           uint64
+	Gossip              bool
+	GossipFanout        uint64
+	Seeds               []NodeAddress
 	WebServerAddress    string
 	Token               uint64
+	Key                 string
+	RequireAuth         bool
+	EncryptKeys         []string
+	Identity            uint32
+	IdentityKey         string
+	CredentialFile      string
+	AdminToken          string
+	RequireIdentity     bool
+	NodeIdFile          string
+	NodeName            string
+	Labels              map[string]string
 	PingEvery           uint64
 	SyncEvery           uint64
 	CheckEvery          uint64
 	DeleteEvery         uint64
 	OfflineTime         uint64
+	ProbeWindow         uint64
+	LossTimeout         uint64
+	MaxPackageAge       uint64
+	FragmentTimeout     uint64
+	FullSyncEvery       uint64
+	Workers             uint64
+	QueueLength         uint64
+	RateLimit           uint64
+	RateBurst           uint64
+	AllowNetworks       []string
+	DenyNetworks        []string
+	Trace               bool
+	Targets             []ProbeTarget
 	Account             []interface{}
 	ItsUrl              string
+	SessionTimeout      uint64
+	SessionRefresh      uint64
+	DryRun              bool
 }
 
 func (s *MainConfig) Load(file_path string) {
@@ -36,21 +120,77 @@ func (s *MainConfig) Load(file_path string) {
 	if err != nil {
 		log.Fatal("Decode config file failed.", err)
 	}
+	if s.ListenNetwork == "" {
+		s.ListenNetwork = "udp"
+	}
+	if s.NodeIdFile == "" {
+		s.NodeIdFile = "./node_id"
+	}
+	if s.NodeName == "" {
+		s.NodeName, _ = os.Hostname()
+	}
 	if s.PingEvery <= 0 {
 		s.PingEvery = 500
 	}
 	if s.SyncEvery <= 0 {
 		s.SyncEvery = 2000
 	}
+	if s.GossipFanout <= 0 {
+		s.GossipFanout = 3
+	}
+	if s.LeaseTime <= 0 {
+		s.LeaseTime = 3 * s.SyncEvery
+	}
 	if s.CheckEvery <= 0 {
 		s.CheckEvery = 3000
 	}
 	if s.OfflineTime <= 0 {
 		s.OfflineTime = 5000
 	}
+	if s.ProbeWindow <= 0 {
+		s.ProbeWindow = 100
+	}
+	if s.LossTimeout <= 0 {
+		s.LossTimeout = 1000
+	}
+	if s.MaxPackageAge <= 0 {
+		s.MaxPackageAge = 60 * 1000
+	}
+	if s.FragmentTimeout <= 0 {
+		s.FragmentTimeout = s.SyncEvery
+	}
+	if s.FullSyncEvery <= 0 {
+		s.FullSyncEvery = 30 * s.SyncEvery
+	}
+	for i := range s.Targets {
+		if s.Targets[i].Timeout <= 0 {
+			s.Targets[i].Timeout = s.LossTimeout
+		}
+		if s.Targets[i].Status <= 0 {
+			s.Targets[i].Status = 200
+		}
+	}
+	if s.Workers <= 0 {
+		s.Workers = uint64(runtime.NumCPU())
+	}
+	if s.QueueLength <= 0 {
+		s.QueueLength = 1024
+	}
+	if s.RateLimit <= 0 {
+		s.RateLimit = 100
+	}
+	if s.RateBurst <= 0 {
+		s.RateBurst = 2 * s.RateLimit
+	}
 	if s.DeleteEvery <= s.OfflineTime {
 		s.DeleteEvery = 24 * 3600 * 1000
 	}
+	if s.SessionTimeout <= 0 {
+		s.SessionTimeout = 1
+	}
+	if s.SessionRefresh <= 0 {
+		s.SessionRefresh = 5 * 60 * 1000
+	}
 }
 
 var instance *MainConfig
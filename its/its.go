@@ -1,6 +1,7 @@
 package its
 
 import (
+	"context"
 	"time"
 	"sync"
 	"net/http"
@@ -14,6 +15,7 @@ import (
 	"github.com/Catofes/go-its/config"
 	"github.com/emirpasic/gods/lists/arraylist"
 	"math"
+	"strconv"
 )
 
 var log *logging.Logger
@@ -27,6 +29,8 @@ type AccountInfo struct {
 	AccountName     string
 	AccountPassword string
 	ConnectLimit    bool
+	DryRun          bool
+	journal         *Journal
 	mutex           sync.Mutex
 }
 
@@ -36,15 +40,39 @@ func (s *AccountInfo) Init(name string, password string) *AccountInfo {
 	return s
 }
 
+// record journals a request once it was answered, or skipped in dry run.
+func (s *AccountInfo) record(rangeValue string, operation string, err error) {
+	result := "ok"
+	if s.DryRun {
+		result = "not sent"
+		log.Warning("Dry run: %s %s with range %s.", operation, s.AccountName, rangeValue)
+	} else if err != nil {
+		result = err.Error()
+	}
+	if s.journal != nil {
+		s.journal.Add(s.AccountName, rangeValue, operation, s.DryRun, result)
+	}
+}
+
 func (s *AccountInfo) Connect() (string, error) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
+	if s.DryRun {
+		s.record("1", "connect", nil)
+		return "", nil
+	}
+	str, err := s.connect()
+	s.record("1", "connect", err)
+	return str, err
+}
+
+func (s *AccountInfo) connect() (string, error) {
 	resp, err := http.PostForm(config.GetInstance("").ItsUrl, url.Values{
 		"uid":       {s.AccountName},
 		"password":  {s.AccountPassword},
 		"range":     {"1"},
 		"operation": {"connect"},
-		"timeout":   {"1"}})
+		"timeout":   {strconv.FormatUint(config.GetInstance("").SessionTimeout, 10)}})
 	if err != nil {
 		log.Warning("Request connection %s failed. Err: %s.", s.AccountName, err.Error())
 		return "", errors.New("Requset Connection Failed.")
@@ -70,12 +98,22 @@ func (s *AccountInfo) Connect() (string, error) {
 }
 
 func (s *AccountInfo) Disconnect() error {
+	if s.DryRun {
+		s.record("4", "disconnectall", nil)
+		return nil
+	}
+	err := s.disconnect()
+	s.record("4", "disconnectall", err)
+	return err
+}
+
+func (s *AccountInfo) disconnect() error {
 	_, err := http.PostForm(config.GetInstance("").ItsUrl, url.Values{
 		"uid":       {s.AccountName},
 		"password":  {s.AccountPassword},
 		"range":     {"4"},
 		"operation": {"disconnectall"},
-		"timeout":   {"1"}})
+		"timeout":   {strconv.FormatUint(config.GetInstance("").SessionTimeout, 10)}})
 	if err != nil {
 		log.Warning("Request disconnection %s failed.", s.AccountName)
 		return errors.New("Requset Disconnect Failed.")
@@ -85,31 +123,65 @@ func (s *AccountInfo) Disconnect() error {
 }
 
 type Manager struct {
-	Accounts        *arraylist.List
-	Status          bool
-	LastText        string
-	LastConnectTime time.Time
-	LastCheckTime   time.Time
-	LostCount       int
-	LostLimit       int
-	Day             int
-	mutex           sync.Mutex
+	Accounts          *arraylist.List
+	Status            bool
+	LastText          string
+	LastConnectTime   time.Time
+	LastCheckTime     time.Time
+	SessionExpireTime time.Time
+	DryRun            bool
+	Active            bool
+	Journal           *Journal
+	LostCount         int
+	LostLimit         int
+	Day               int
+	sessionLifetime   time.Duration
+	sessionRefresh    time.Duration
+	mutex             sync.Mutex
 }
 
 func (s *Manager) Init() *Manager {
 	c := config.GetInstance("")
 	s.Accounts = arraylist.New()
+	s.DryRun = c.DryRun
+	s.Journal = (&Journal{}).Init(100)
 	for _, v := range c.Account {
 		a := v.(map[string]interface{})
 		u := a["Username"].(string)
 		p := a["Password"].(string)
-		s.Accounts.Add((&AccountInfo{}).Init(u, p))
+		account := (&AccountInfo{}).Init(u, p)
+		account.DryRun = s.DryRun
+		account.journal = s.Journal
+		s.Accounts.Add(account)
 	}
 	s.LostLimit = 1
+	// With several centers only the elected one drives the gateway, the
+	// others stand by until the election says otherwise.
+	s.Active = len(c.Centers) <= 1
+	s.sessionLifetime = time.Duration(c.SessionTimeout) * time.Hour
+	s.sessionRefresh = time.Duration(c.SessionRefresh) * time.Millisecond
 	ItsManager = s
 	return s
 }
 
+// SetActive makes this manager drive the gateway, or stand by while another
+// center does.
+func (s *Manager) SetActive(active bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.Active != active {
+		log.Warning("Gateway manager active: %t.", active)
+	}
+	s.Active = active
+}
+
+// IsActive tells if this manager drives the gateway.
+func (s *Manager) IsActive() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Active
+}
+
 func (s *Manager) LinkDown() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
@@ -159,16 +231,23 @@ func (s *Manager) connect() {
 	}
 	if account != nil {
 		str, err := account.Connect()
-		if err == nil {
+		// A dry run opens no session to refresh.
+		if err == nil && !account.DryRun {
 			s.LastConnectTime = time.Now()
+			s.SessionExpireTime = s.LastConnectTime.Add(s.sessionLifetime)
 			s.LastText = str
 		}
 	}
 }
 
-func (s *Manager) Loop() {
+// Loop resets the daily connect limits until ctx is done.
+func (s *Manager) Loop(ctx context.Context) {
 	for {
-		time.Sleep(1 * time.Hour)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(1 * time.Hour):
+		}
 		s.mutex.Lock()
 		now := time.Now()
 		if now.Day() != s.Day {
@@ -181,3 +260,36 @@ func (s *Manager) Loop() {
 		s.mutex.Unlock()
 	}
 }
+
+// SessionLoop logins again shortly before the gateway session expires, while
+// the manager is active. It checks often enough not to miss sessionRefresh.
+func (s *Manager) SessionLoop(ctx context.Context) {
+	every := s.sessionRefresh / 2
+	if every <= 0 || every > time.Minute {
+		every = time.Minute
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(every):
+		}
+		s.refresh(time.Now())
+	}
+}
+
+// refresh logins again if the session expires within sessionRefresh of now,
+// or already expired, say after a failed refresh or while standing by.
+func (s *Manager) refresh(now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.Active || s.SessionExpireTime.IsZero() || !now.Add(s.sessionRefresh).After(s.SessionExpireTime) {
+		return
+	}
+	if now.Before(s.SessionExpireTime) {
+		log.Warning("Session expire at %s, refresh.", s.SessionExpireTime.Format("2006-01-02 15:04:05"))
+	} else {
+		log.Warning("Session expired at %s, login again.", s.SessionExpireTime.Format("2006-01-02 15:04:05"))
+	}
+	s.connect()
+}
@@ -1,8 +1,12 @@
 package its
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 	"github.com/Catofes/go-its/config"
+	"github.com/emirpasic/gods/lists/arraylist"
 )
 
 func TestAccountInfo_Connect(t *testing.T) {
@@ -16,4 +20,121 @@ func TestManager_Init(t *testing.T) {
 	config.GetInstance("./test.json")
 	m := (&Manager{}).Init()
 	log.Debug("%v", m.Accounts)
+	if !m.IsActive() {
+		t.Fatal("Single center standing by.")
+	}
+	c := config.GetInstance("./test.json")
+	centers := c.Centers
+	defer func() { c.Centers = centers }()
+	c.Centers = []config.NodeAddress{{Address: "10.0.0.1", Port: 1000}, {Address: "10.0.0.2", Port: 1000}}
+	if (&Manager{}).Init().IsActive() {
+		t.Fatal("Center active before the election.")
+	}
+}
+
+// gateway points the configured gateway at a test server which answers
+// every request.
+func gateway() func() {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	c := config.GetInstance("./test.json")
+	url := c.ItsUrl
+	c.ItsUrl = server.URL
+	return func() {
+		c.ItsUrl = url
+		server.Close()
+	}
+}
+
+func TestManager_SessionRefresh(t *testing.T) {
+	defer gateway()()
+	now := time.Now()
+	account := (&AccountInfo{}).Init("111111", "111111")
+	m := &Manager{Accounts: arraylist.New(), Active: true, sessionLifetime: time.Hour, sessionRefresh: 5 * time.Minute}
+	m.Accounts.Add(account)
+
+	m.SessionExpireTime = now.Add(10 * time.Minute)
+	m.refresh(now)
+	if !m.LastConnectTime.IsZero() {
+		t.Fatal("Refreshed long before expiry.")
+	}
+	m.Active = false
+	m.refresh(now.Add(6 * time.Minute))
+	if !m.LastConnectTime.IsZero() {
+		t.Fatal("Refreshed while standing by.")
+	}
+	m.Active = true
+	m.refresh(now.Add(6 * time.Minute))
+	if m.LastConnectTime.IsZero() || !m.SessionExpireTime.After(now.Add(time.Hour)) {
+		t.Fatal("Not refreshed before expiry.", m.SessionExpireTime)
+	}
+
+	// An expired session, say after a failed refresh, is logged in again.
+	m.LastConnectTime = time.Time{}
+	m.SessionExpireTime = now.Add(-time.Minute)
+	m.refresh(now)
+	if m.LastConnectTime.IsZero() || !m.SessionExpireTime.After(now) {
+		t.Fatal("Expired session not logged in again.", m.SessionExpireTime)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	j := (&Journal{}).Init(2)
+	j.Add("a", "1", "connect", false, "ok")
+	j.Add("b", "4", "disconnectall", true, "not sent")
+	j.Add("c", "1", "connect", true, "not sent")
+	entries := j.Entries()
+	if len(entries) != 2 || entries[0].Account != "b" || entries[1].Account != "c" {
+		t.Fatal("Error journal entries.", entries)
+	}
+	if entries[0].Operation != "disconnectall" || entries[0].Range != "4" || !entries[0].DryRun || entries[0].Result != "not sent" {
+		t.Fatal("Error journal entry.", entries[0])
+	}
+}
+
+func TestAccountInfo_DryRun(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	}))
+	defer server.Close()
+	c := config.GetInstance("./test.json")
+	url := c.ItsUrl
+	c.ItsUrl = server.URL
+	defer func() { c.ItsUrl = url }()
+
+	journal := (&Journal{}).Init(10)
+	account := (&AccountInfo{}).Init("111111", "111111")
+	account.journal = journal
+	account.DryRun = true
+	account.Connect()
+	account.Disconnect()
+	if requests != 0 {
+		t.Fatal("Dry run sent requests.", requests)
+	}
+	entries := journal.Entries()
+	if len(entries) != 2 || !entries[0].DryRun || entries[0].Operation != "connect" || entries[1].Operation != "disconnectall" {
+		t.Fatal("Dry run not recorded.", entries)
+	}
+
+	account.DryRun = false
+	account.Connect()
+	if requests != 1 || len(journal.Entries()) != 3 || journal.Entries()[2].DryRun || journal.Entries()[2].Result != "ok" {
+		t.Fatal("Request not sent.", requests)
+	}
+
+	// A failed request is journaled with its error.
+	c.ItsUrl = "http://127.0.0.1:1/"
+	account.Connect()
+	if entry := journal.Entries()[3]; entry.Result == "ok" || entry.Result == "" {
+		t.Fatal("Failure not journaled.", entry)
+	}
+
+	// A dry run opens no session.
+	account.DryRun = true
+	m := &Manager{Accounts: arraylist.New(), Active: true, sessionLifetime: time.Hour}
+	m.Accounts.Add(account)
+	m.Connect()
+	if !m.LastConnectTime.IsZero() || !m.SessionExpireTime.IsZero() {
+		t.Fatal("Dry run opened a session.", m.SessionExpireTime)
+	}
 }
@@ -0,0 +1,49 @@
+package its
+
+import (
+	"sync"
+	"time"
+	"github.com/emirpasic/gods/lists/arraylist"
+)
+
+type JournalEntry struct {
+	Time      time.Time
+	Account   string
+	Range     string
+	Operation string
+	DryRun    bool
+	Result    string
+}
+
+// Journal keeps the latest requests sent (or, in dry run, not sent) to the
+// gateway, with their result.
+type Journal struct {
+	entries *arraylist.List
+	size    int
+	mutex   sync.Mutex
+}
+
+func (s *Journal) Init(size int) *Journal {
+	s.entries = arraylist.New()
+	s.size = size
+	return s
+}
+
+func (s *Journal) Add(account string, rangeValue string, operation string, dryRun bool, result string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries.Add(&JournalEntry{time.Now(), account, rangeValue, operation, dryRun, result})
+	for s.entries.Size() > s.size {
+		s.entries.Remove(0)
+	}
+}
+
+func (s *Journal) Entries() []JournalEntry {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := make([]JournalEntry, 0, s.entries.Size())
+	for _, v := range s.entries.Values() {
+		result = append(result, *v.(*JournalEntry))
+	}
+	return result
+}
@@ -0,0 +1,62 @@
+package udp
+
+import (
+	"errors"
+	"net"
+)
+
+const (
+	addressFamilyNone = 0
+	addressFamilyIPv4 = 4
+	addressFamilyIPv6 = 6
+)
+
+// addressLength returns the encoded size of ip: one family byte followed by
+// 4 bytes for IPv4, 16 bytes for IPv6 or nothing for an empty address.
+func addressLength(ip net.IP) int {
+	if ip == nil {
+		return 1
+	}
+	if ip.To4() != nil {
+		return 1 + net.IPv4len
+	}
+	return 1 + net.IPv6len
+}
+
+func putAddress(data []byte, ip net.IP) int {
+	if ip == nil {
+		data[0] = addressFamilyNone
+		return 1
+	}
+	if v4 := ip.To4(); v4 != nil {
+		data[0] = addressFamilyIPv4
+		copy(data[1:1+net.IPv4len], v4)
+		return 1 + net.IPv4len
+	}
+	data[0] = addressFamilyIPv6
+	copy(data[1:1+net.IPv6len], ip.To16())
+	return 1 + net.IPv6len
+}
+
+func readAddress(data []byte) (net.IP, int, error) {
+	if len(data) < 1 {
+		return nil, 0, errors.New("Address truncated.")
+	}
+	length := 0
+	switch data[0] {
+	case addressFamilyNone:
+		return nil, 1, nil
+	case addressFamilyIPv4:
+		length = net.IPv4len
+	case addressFamilyIPv6:
+		length = net.IPv6len
+	default:
+		return nil, 0, errors.New("Unknown address family.")
+	}
+	if len(data) < 1+length {
+		return nil, 0, errors.New("Address truncated.")
+	}
+	ip := make(net.IP, length)
+	copy(ip, data[1:1+length])
+	return ip, 1 + length, nil
+}
@@ -0,0 +1,65 @@
+package udp
+
+import (
+	"sync"
+	"time"
+)
+
+// ClockFilterSize is how many recent samples the offset is chosen from.
+const ClockFilterSize = 8
+
+type clockSample struct {
+	offset int64
+	delay  int64
+}
+
+// ClockEstimator estimates the clock offset of a remote server the way NTP
+// does: each echo gives an offset and a round trip delay, and the offset of
+// the sample with the lowest delay among the recent ones is kept, as it is
+// the least disturbed by queueing. Offset is remote clock minus local clock.
+// ForwardDelay and ReverseDelay are the one way delays of the last echo
+// under that offset.
+type ClockEstimator struct {
+	Offset       int64
+	Delay        int64
+	ForwardDelay int64
+	ReverseDelay int64
+	Samples      int64
+	samples      [ClockFilterSize]clockSample
+	mutex        sync.Mutex
+}
+
+// Add records an echo sent at t1 and received by the remote server at t2,
+// replied at t3 and received back at t4.
+func (s *ClockEstimator) Add(t1, t2, t3, t4 int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sample := clockSample{((t2 - t1) + (t3 - t4)) / 2, (t4 - t1) - (t3 - t2)}
+	if sample.delay < 0 {
+		sample.delay = 0
+	}
+	s.samples[s.Samples%ClockFilterSize] = sample
+	s.Samples++
+	count := s.Samples
+	if count > ClockFilterSize {
+		count = ClockFilterSize
+	}
+	best := s.samples[0]
+	for _, v := range s.samples[1:count] {
+		if v.delay < best.delay {
+			best = v
+		}
+	}
+	s.Offset = best.offset
+	s.Delay = best.delay
+	s.ForwardDelay = t2 - t1 - s.Offset
+	s.ReverseDelay = t4 - t3 + s.Offset
+}
+
+// LocalTime converts a timestamp of the remote clock to the local clock.
+func (s *ClockEstimator) LocalTime(remote int64) time.Time {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	local := remote - s.Offset
+	return time.Unix(local/1e9, local%1e9)
+}
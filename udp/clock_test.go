@@ -0,0 +1,32 @@
+package udp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockEstimator(t *testing.T) {
+	c := &ClockEstimator{}
+	offset := int64(5 * time.Second)
+	now := time.Now().UnixNano()
+	// Forward 10ms, reverse 30ms, remote clock 5s ahead, 1ms processing.
+	for i := int64(0); i < 10; i++ {
+		t1 := now + i*int64(time.Second)
+		queue := (i % 3) * int64(20*time.Millisecond)
+		t2 := t1 + int64(10*time.Millisecond) + queue + offset
+		t3 := t2 + int64(time.Millisecond)
+		t4 := t3 - offset + int64(30*time.Millisecond)
+		c.Add(t1, t2, t3, t4)
+	}
+	// Symmetric delay is assumed, so the 20ms asymmetry shows as 10ms error.
+	if c.Offset != offset-int64(10*time.Millisecond) || c.Delay != int64(40*time.Millisecond) {
+		t.Fatal("Error offset or delay.", c.Offset, c.Delay)
+	}
+	if c.ForwardDelay+c.ReverseDelay != int64(40*time.Millisecond) {
+		t.Fatal("Error one way delays.", c.ForwardDelay, c.ReverseDelay)
+	}
+	remote := now + offset
+	if d := c.LocalTime(remote).Sub(time.Unix(0, now)); d != 10*time.Millisecond {
+		t.Fatal("Error local time.", d)
+	}
+}
@@ -0,0 +1,142 @@
+package udp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Credential is the key of one client. Packages signed with Identity 0 use
+// the shared key instead, which is still used between clients.
+type Credential struct {
+	Id        uint32
+	Name      string
+	Key       string
+	Revoked   bool
+	Created   time.Time
+	RevokedAt time.Time
+}
+
+// CredentialStore is the registry of client credentials kept by the center,
+// persisted as json in path.
+type CredentialStore struct {
+	path        string
+	credentials map[uint32]*Credential
+	nextId      uint32
+	mutex       sync.Mutex
+}
+
+func (s *CredentialStore) Init(path string) *CredentialStore {
+	s.path = path
+	s.credentials = make(map[uint32]*Credential)
+	s.nextId = 1
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Fatal("Load credential file failed.", err)
+		}
+		return s
+	}
+	list := make([]*Credential, 0)
+	if err := json.Unmarshal(data, &list); err != nil {
+		log.Fatal("Decode credential file failed.", err)
+	}
+	for _, v := range list {
+		s.credentials[v.Id] = v
+		if v.Id >= s.nextId {
+			s.nextId = v.Id + 1
+		}
+	}
+	return s
+}
+
+func (s *CredentialStore) save() error {
+	list := make([]*Credential, 0, len(s.credentials))
+	for i := uint32(1); i < s.nextId; i++ {
+		if v, ok := s.credentials[i]; ok {
+			list = append(list, v)
+		}
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(s.path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+// Add creates a credential with a random key for a new client. The client
+// can only use it once it was saved.
+func (s *CredentialStore) Add(name string) (Credential, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return Credential{}, err
+	}
+	credential := &Credential{Id: s.nextId, Name: name, Key: hex.EncodeToString(key), Created: time.Now()}
+	s.credentials[credential.Id] = credential
+	s.nextId++
+	if err := s.save(); err != nil {
+		delete(s.credentials, credential.Id)
+		s.nextId--
+		return Credential{}, err
+	}
+	return *credential, nil
+}
+
+// Revoke stops accepting the key of a client, once that was saved so it
+// stays revoked after a restart.
+func (s *CredentialStore) Revoke(id uint32) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	credential, ok := s.credentials[id]
+	if !ok {
+		return ErrUnknownIdentity
+	}
+	if credential.Revoked {
+		return nil
+	}
+	credential.Revoked = true
+	credential.RevokedAt = time.Now()
+	if err := s.save(); err != nil {
+		credential.Revoked = false
+		credential.RevokedAt = time.Time{}
+		return err
+	}
+	return nil
+}
+
+// List returns all credentials without their keys.
+func (s *CredentialStore) List() []Credential {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	result := make([]Credential, 0, len(s.credentials))
+	for i := uint32(1); i < s.nextId; i++ {
+		if v, ok := s.credentials[i]; ok {
+			credential := *v
+			credential.Key = ""
+			result = append(result, credential)
+		}
+	}
+	return result
+}
+
+func (s *CredentialStore) Key(id uint32) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	credential, ok := s.credentials[id]
+	if !ok {
+		return nil, ErrUnknownIdentity
+	}
+	if credential.Revoked {
+		return nil, ErrRevokedIdentity
+	}
+	return hex.DecodeString(credential.Key)
+}
@@ -0,0 +1,91 @@
+package udp
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+)
+
+func TestCredentialStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	store := (&CredentialStore{}).Init(path)
+	SetCredentials(store)
+	defer SetCredentials(nil)
+	a, err := store.Add("a")
+	if err != nil {
+		t.Fatal("Add credential failed.", err)
+	}
+	b, _ := store.Add("b")
+	if a.Id == b.Id || a.Key == b.Key {
+		t.Fatal("Credentials not unique.", a, b)
+	}
+
+	// A client signs with its own key, the center verifies with the registry.
+	key, _ := hex.DecodeString(a.Key)
+	SetIdentity(a.Id, key)
+	header := NewHeader(PackageTypeEchoRequest, ProtocolVersion, LocalCapabilities)
+	header.Identity = a.Id
+	data := (&EchoPackage{Id: 1}).ToData(header)
+	SetIdentity(0, nil)
+	if r, _, err := LoadHeader(data); err != nil || r.Identity != a.Id {
+		t.Fatal("Verify client package failed.", err)
+	}
+	data[len(data)-1] ^= 1
+	if _, _, err := LoadHeader(data); err == nil {
+		t.Fatal("Accepted wrong signature.")
+	}
+	data[len(data)-1] ^= 1
+
+	if err := store.Revoke(a.Id); err != nil {
+		t.Fatal("Revoke failed.", err)
+	}
+	if _, _, err := LoadHeader(data); err == nil {
+		t.Fatal("Accepted revoked identity.")
+	}
+
+	reload := (&CredentialStore{}).Init(path)
+	list := reload.List()
+	if len(list) != 2 || !list[0].Revoked || list[1].Revoked || list[0].Key != "" {
+		t.Fatal("Error reloaded credentials.", list)
+	}
+	if c, _ := reload.Add("c"); c.Id <= b.Id {
+		t.Fatal("Identity reused.", c.Id)
+	}
+}
+
+func TestCredentialStoreSaveFails(t *testing.T) {
+	dir := t.TempDir()
+	store := (&CredentialStore{}).Init(filepath.Join(dir, "credentials.json"))
+	a, err := store.Add("a")
+	if err != nil {
+		t.Fatal("Add failed.", err)
+	}
+	// Nothing changes in memory when the file can't be written.
+	store.path = filepath.Join(dir, "missing", "credentials.json")
+	if _, err := store.Add("b"); err == nil {
+		t.Fatal("Unsaved credential added.")
+	}
+	if len(store.List()) != 1 || store.nextId != 2 {
+		t.Fatal("Unsaved credential kept.", store.List())
+	}
+	if err := store.Revoke(a.Id); err == nil {
+		t.Fatal("Unsaved revocation succeeded.")
+	}
+	if _, err := store.Key(a.Id); err != nil {
+		t.Fatal("Unsaved revocation applied.", err)
+	}
+}
+
+func TestAdminAuthorized(t *testing.T) {
+	if !adminAuthorized("Bearer secret", "secret") {
+		t.Fatal("Admin token refused.")
+	}
+	for _, authorization := range []string{"", "secret", "Bearer secre", "Bearer secret2", "Basic secret"} {
+		if adminAuthorized(authorization, "secret") {
+			t.Fatal("Wrong admin token accepted.", authorization)
+		}
+	}
+	if adminAuthorized("Bearer ", "") {
+		t.Fatal("Empty admin token accepted.")
+	}
+}
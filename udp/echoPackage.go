@@ -2,46 +2,92 @@ package udp
 
 import (
 	"encoding/binary"
-	"net"
+	"errors"
 	"time"
 )
 
+// EchoPackageLength is the size of a legacy echo package, EchoPayloadLength
+// the size of the echo payload after a versioned header. Starting with
+// ClockVersion the payload also carries ReceiveTimestamp.
 const EchoPackageLength = 23
+const EchoPayloadLength = 20
+const ClockEchoPayloadLength = 28
 
+// EchoPackage is a probe. EchoTimestamp is set by the sender in its clock,
+// ReceiveTimestamp and ReplyTimestamp by the remote server in its clock.
+// Relay is the round trip measured locally, it is not sent.
 type EchoPackage struct {
-	Id             int
-	EchoTimestamp  int64
-	ReplyTimestamp int64
-	Relay          int64
+	Id               int
+	EchoTimestamp    int64
+	ReceiveTimestamp int64
+	ReplyTimestamp   int64
+	Relay            int64
 }
 
-func (s *EchoPackage) ToData() (data []byte) {
-	data = make([]byte, EchoPackageLength)
-	data[0] = 0
-	binary.BigEndian.PutUint32(data[1:5], uint32(s.Id))
-	binary.BigEndian.PutUint64(data[5:13], uint64(s.EchoTimestamp))
-	binary.BigEndian.PutUint64(data[13:21], uint64(s.ReplyTimestamp))
-	return data
+// echoPayloadLength is the payload size of an echo package in version.
+func echoPayloadLength(version byte) int {
+	if version == 0 {
+		return EchoPackageLength - 1
+	} else if version >= ClockVersion {
+		return ClockEchoPayloadLength
+	}
+	return EchoPayloadLength
+}
+
+func (s *EchoPackage) ToData(header *Header) (data []byte) {
+	data, start := header.ToData(echoPayloadLength(header.Version))
+	binary.BigEndian.PutUint32(data[start:start+4], uint32(s.Id))
+	binary.BigEndian.PutUint64(data[start+4:start+12], uint64(s.EchoTimestamp))
+	binary.BigEndian.PutUint64(data[start+12:start+20], uint64(s.ReplyTimestamp))
+	if header.Version >= ClockVersion {
+		binary.BigEndian.PutUint64(data[start+20:start+28], uint64(s.ReceiveTimestamp))
+	}
+	return header.Seal(data)
+}
+
+func (s *EchoPackage) LoadFromData(header *Header, data []byte) error {
+	if len(data) != echoPayloadLength(header.Version) {
+		return errors.New("Wrong package size.")
+	}
+	s.Id = int(binary.BigEndian.Uint32(data[0:4]))
+	s.EchoTimestamp = int64(binary.BigEndian.Uint64(data[4:12]))
+	s.ReplyTimestamp = int64(binary.BigEndian.Uint64(data[12:20]))
+	s.ReceiveTimestamp = s.ReplyTimestamp
+	if header.Version >= ClockVersion {
+		s.ReceiveTimestamp = int64(binary.BigEndian.Uint64(data[20:28]))
+	}
+	return nil
 }
 
-func (s *EchoPackage) LoadFromData(data []byte) {
-	s.Id = int(binary.BigEndian.Uint32(data[1:5]))
-	s.EchoTimestamp = int64(binary.BigEndian.Uint64(data[5:13]))
-	s.ReplyTimestamp = int64(binary.BigEndian.Uint64(data[13:21]))
+// DecodeEcho is the codec of echo requests and replies.
+func DecodeEcho(header *Header, payload []byte) (interface{}, error) {
+	echoPackage := &EchoPackage{}
+	if err := echoPackage.LoadFromData(header, payload); err != nil {
+		return nil, err
+	}
+	return echoPackage, nil
 }
 
-func EchoRequestHandler(conn *net.UDPConn, addr *net.UDPAddr, n int, data []byte) {
-	packageType := byte(0)
-	if n != EchoPackageLength {
-		log.Info("Wrong package size at package type %d.", packageType)
+func EchoRequestHandler(r *Request) {
+	receiveTimestamp := time.Now().UnixNano()
+	conn, addr, header := r.Connection, r.Address, r.Header
+	echoPackage := r.Message.(*EchoPackage)
+	// Unknown hosts, and replayed requests with a spoofed source, could use
+	// the reply to reflect traffic.
+	if !knownPeer(addr, header) {
+		countDrop(&drops.UnknownPeer)
+		return
 	}
-	echoPackage := EchoPackage{}
-	echoPackage.LoadFromData(data)
+	echoPackage.ReceiveTimestamp = receiveTimestamp
 	echoPackage.ReplyTimestamp = time.Now().UnixNano()
-	data = echoPackage.ToData()
-	data[0] = 1
+	replyHeader := NewHeader(PackageTypeEchoReply, header.Version, header.Capabilities)
+	replyHeader.Identity = header.Identity
+	data := echoPackage.ToData(replyHeader)
+	if data == nil {
+		return
+	}
 	n, err := conn.WriteToUDP(data, addr)
-	if err != nil || n != EchoPackageLength {
+	if err != nil || n != len(data) {
 		log.Info("Write package to %s wrong.", addr.String())
 	}
 }
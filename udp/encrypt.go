@@ -0,0 +1,77 @@
+package udp
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Encrypted payloads are laid out as key id, nonce and the sealed
+// plaintext. The key id lets receivers pick between the two keys which are
+// active during a rollover.
+const KeyIdLength = 4
+const EncryptOverhead = KeyIdLength + chacha20poly1305.NonceSize + chacha20poly1305.Overhead
+const MaxEncryptKeys = 2
+
+type encryptKey struct {
+	id   []byte
+	aead cipher.AEAD
+}
+
+// encryptKeys[0] encrypts, every key decrypts.
+var encryptKeys []*encryptKey
+
+// SetEncryptKeys loads hex encoded 32 bytes keys. The first key is used to
+// encrypt, the second one is only accepted, so nodes can be moved to a new
+// key one by one. An empty list disables encryption.
+func SetEncryptKeys(keys []string) error {
+	if len(keys) > MaxEncryptKeys {
+		return errors.New("Too many encrypt keys.")
+	}
+	result := make([]*encryptKey, 0, len(keys))
+	for _, v := range keys {
+		key, err := hex.DecodeString(v)
+		if err != nil {
+			return err
+		}
+		aead, err := chacha20poly1305.New(key)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(key)
+		result = append(result, &encryptKey{sum[:KeyIdLength], aead})
+	}
+	encryptKeys = result
+	if len(encryptKeys) > 0 {
+		LocalCapabilities |= CapabilityEncryption
+	} else {
+		LocalCapabilities &^= CapabilityEncryption
+	}
+	return nil
+}
+
+func encrypt(additional []byte, plaintext []byte) []byte {
+	key := encryptKeys[0]
+	data := make([]byte, KeyIdLength+chacha20poly1305.NonceSize, EncryptOverhead+len(plaintext))
+	copy(data, key.id)
+	nonce := data[KeyIdLength:]
+	rand.Read(nonce)
+	return key.aead.Seal(data, nonce, plaintext, additional)
+}
+
+func decrypt(additional []byte, data []byte) ([]byte, error) {
+	if len(data) < EncryptOverhead {
+		return nil, errors.New("Encrypted payload truncated.")
+	}
+	for _, key := range encryptKeys {
+		if string(key.id) != string(data[:KeyIdLength]) {
+			continue
+		}
+		nonce := data[KeyIdLength : KeyIdLength+chacha20poly1305.NonceSize]
+		return key.aead.Open(nil, nonce, data[KeyIdLength+chacha20poly1305.NonceSize:], additional)
+	}
+	return nil, errors.New("Unknown encrypt key.")
+}
@@ -0,0 +1,158 @@
+package udp
+
+import (
+	"net"
+	"testing"
+)
+
+// seedPackages encodes every package type in every protocol version.
+func seedPackages() [][]byte {
+	var result [][]byte
+	for version := byte(0); version <= ProtocolVersion; version++ {
+		for _, packageType := range []byte{PackageTypeEchoRequest, PackageTypeEchoReply} {
+			echo := EchoPackage{Id: 3, EchoTimestamp: 1e18, ReceiveTimestamp: 2e18, ReplyTimestamp: 2e18}
+			result = append(result, echo.ToData(NewHeader(packageType, version, 0)))
+		}
+		p := (&SyncPackage{}).Init()
+		p.Self = ServerInfo{Ip: net.ParseIP("10.0.0.1"), Port: 1000}
+		p.Token = 42
+		p.Node = NodeInfo{NodeId{1, 2, 3}, "node", map[string]string{"zone": "a"}}
+		p.StateVersion = 7
+		p.Parameters = Parameters{PingEvery: 500, OfflineTime: 5000}
+		p.Servers.Push(&ServerInfo{Ip: net.ParseIP("10.0.0.2"), Port: 2000, PackageLost: 0.5, NodeId: NodeId{4}})
+		p.Servers.Push(&ServerInfo{Ip: net.ParseIP("2001:db8::1"), Port: 3000, Removed: true})
+		d, n := p.ToData(NewHeader(PackageTypeSync, version, 0))
+		for i := 0; i < n; i++ {
+			result = append(result, d[i])
+		}
+		if version >= GoodbyeVersion {
+			result = append(result, (&GoodbyePackage{NodeId{5}}).ToData(NewHeader(PackageTypeGoodbye, version, 0)))
+		}
+		if version >= RegisterVersion {
+			result = append(result, (&RegisterPackage{p.Node}).ToData(NewHeader(PackageTypeRegister, version, 0)))
+			ack := RegisterAck{RegisterOK, 1, net.ParseIP("10.0.0.1"), 1000, 500, 2000, 5000}
+			result = append(result, ack.ToData(NewHeader(PackageTypeRegisterAck, version, 0)))
+		}
+		if version >= LeaseVersion {
+			result = append(result, (&LeasePackage{3, NodeId{5}, 6000}).ToData(NewHeader(PackageTypeLease, version, 0)))
+			result = append(result, (&LeasePackage{3, NodeId{5}, 6000}).ToData(NewHeader(PackageTypeLeaseAck, version, 0)))
+		}
+		if version >= GossipVersion {
+			probe := ProbePackage{ServerInfo{Ip: net.ParseIP("10.0.0.2"), Port: 2000, NodeId: NodeId{4}}}
+			result = append(result, probe.ToData(NewHeader(PackageTypeProbeRequest, version, 0)))
+			p.Servers.Push(&ServerInfo{Ip: net.ParseIP("10.0.0.2"), Port: 2000, NodeId: NodeId{4}})
+			d, n := p.ToData(NewHeader(PackageTypeGossip, version, 0))
+			for i := 0; i < n; i++ {
+				result = append(result, d[i])
+			}
+		}
+	}
+	return result
+}
+
+// FuzzPackage decodes packages the way the listener and handlers do.
+func FuzzPackage(f *testing.F) {
+	for _, d := range seedPackages() {
+		f.Add(d)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header, payload, err := LoadHeader(data)
+		if err != nil {
+			return
+		}
+		switch header.Type {
+		case PackageTypeEchoRequest, PackageTypeEchoReply:
+			checkEcho(t, header, payload)
+		case PackageTypeSync:
+			checkSync(t, header, payload)
+		case PackageTypeRegister:
+			DecodeRegister(header, payload)
+		case PackageTypeRegisterAck:
+			DecodeRegisterAck(header, payload)
+		case PackageTypeLease, PackageTypeLeaseAck:
+			DecodeLease(header, payload)
+		case PackageTypeGossip:
+			checkSync(t, header, payload)
+		case PackageTypeProbeRequest, PackageTypeProbeReply:
+			DecodeProbe(header, payload)
+		case PackageTypeGoodbye:
+			if _, err := DecodeGoodbye(header, payload); err == nil && len(payload) != GoodbyePackageLength {
+				t.Fatal("Error goodbye size.", len(payload))
+			}
+		}
+	})
+}
+
+func FuzzEchoPackage(f *testing.F) {
+	for version := byte(0); version <= ProtocolVersion; version++ {
+		header := NewHeader(PackageTypeEchoRequest, version, 0)
+		data := (&EchoPackage{Id: 1, EchoTimestamp: 2}).ToData(header)
+		_, payload, _ := LoadHeader(data)
+		f.Add(version, payload)
+	}
+	f.Fuzz(func(t *testing.T, version byte, payload []byte) {
+		if version > ProtocolVersion {
+			return
+		}
+		checkEcho(t, &Header{Version: version, Type: PackageTypeEchoRequest}, payload)
+	})
+}
+
+func FuzzSyncPackage(f *testing.F) {
+	for _, d := range seedPackages() {
+		if header, payload, err := LoadHeader(d); err == nil && header.Type == PackageTypeSync {
+			f.Add(header.Version, payload)
+		}
+	}
+	f.Fuzz(func(t *testing.T, version byte, payload []byte) {
+		if version > ProtocolVersion {
+			return
+		}
+		checkSync(t, &Header{Version: version, Type: PackageTypeSync}, payload)
+	})
+}
+
+// checkEcho decodes an echo package, and checks a decoded one encodes back
+// to the same package.
+func checkEcho(t *testing.T, header *Header, payload []byte) {
+	p := EchoPackage{}
+	if p.LoadFromData(header, payload) != nil {
+		return
+	}
+	_, data, err := LoadHeader(p.ToData(NewHeader(header.Type, header.Version, 0)))
+	if err != nil {
+		t.Fatal("Load encoded echo failed.", err)
+	}
+	r := EchoPackage{}
+	if err := r.LoadFromData(header, data); err != nil || r != p {
+		t.Fatal("Echo differs.", p, r, err)
+	}
+}
+
+// checkSync decodes a sync package, and checks the fields of a decoded one
+// are valid and its servers encode back to the same servers.
+func checkSync(t *testing.T, header *Header, payload []byte) {
+	p := SyncPackage{}
+	if p.LoadFromData(header, payload) != nil {
+		return
+	}
+	if header.Version >= FragmentVersion && (p.Index >= p.Total || p.Total > MaxFragments) {
+		t.Fatal("Error fragment.", p.Index, p.Total)
+	}
+	for _, v := range p.Servers.Values() {
+		server := v.(*ServerInfo)
+		if server.PackageLost < 0 || server.PackageLost > 1 {
+			t.Fatal("Error package lost.", server.PackageLost)
+		}
+		data := make([]byte, server.length(header.Version))
+		server.toData(header.Version, data)
+		r := ServerInfo{}
+		if n, err := r.loadFromData(header.Version, data); err != nil || n != len(data) {
+			t.Fatal("Load encoded server failed.", err)
+		}
+		if !r.Ip.Equal(server.Ip) || r.Port != server.Port || r.NodeId != server.NodeId ||
+			r.Removed != server.Removed || r.LastOnline != server.LastOnline {
+			t.Fatal("Server differs.", server, r)
+		}
+	}
+}
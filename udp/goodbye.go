@@ -0,0 +1,37 @@
+package udp
+
+import (
+	"errors"
+)
+
+// GoodbyePackageLength is the payload size of a goodbye package.
+const GoodbyePackageLength = NodeIdLength
+
+// GoodbyePackage tells the peers a server shuts down, so they forget it at
+// once instead of waiting for it to time out.
+type GoodbyePackage struct {
+	Node NodeId
+}
+
+func (s *GoodbyePackage) ToData(header *Header) []byte {
+	data, start := header.ToData(GoodbyePackageLength)
+	copy(data[start:start+NodeIdLength], s.Node[:])
+	return header.Seal(data)
+}
+
+func (s *GoodbyePackage) LoadFromData(header *Header, data []byte) error {
+	if header.Version < GoodbyeVersion || len(data) != GoodbyePackageLength {
+		return errors.New("Wrong package size.")
+	}
+	copy(s.Node[:], data)
+	return nil
+}
+
+// DecodeGoodbye is the codec of goodbye packages.
+func DecodeGoodbye(header *Header, payload []byte) (interface{}, error) {
+	p := &GoodbyePackage{}
+	if err := p.LoadFromData(header, payload); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
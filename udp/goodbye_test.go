@@ -0,0 +1,67 @@
+package udp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func goodbyeRequest(t *testing.T, id NodeId, address *net.UDPAddr) *Request {
+	data := (&GoodbyePackage{id}).ToData(NewHeader(PackageTypeGoodbye, ProtocolVersion, 0))
+	header, payload, err := LoadHeader(data)
+	if err != nil {
+		t.Fatal("Load goodbye failed.", err)
+	}
+	message, err := DecodeGoodbye(header, payload)
+	if err != nil || *message.(*GoodbyePackage) != (GoodbyePackage{id}) {
+		t.Fatal("Decode goodbye failed.", err)
+	}
+	return &Request{nil, address, header, payload, message}
+}
+
+func TestGoodbyeHandler(t *testing.T) {
+	a := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	b := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2000}
+	s := &MainService{Servers: make(map[string]*RemoteServer), maxAge: time.Minute}
+	for i, address := range []*net.UDPAddr{a, b} {
+		v := (&RemoteServer{}).Init(address.IP, uint16(address.Port))
+		v.NodeId = NodeId{byte(i + 1)}
+		s.Servers[v.key()] = v
+	}
+	s.Servers[(&RemoteServer{NodeId: NodeId{2}}).key()].Center = true
+	s.election = (&Election{}).Init(NodeId{3}, time.Second, false, 2, time.Now())
+
+	// Another server can't say goodbye for a.
+	s.goodbyeHandler(goodbyeRequest(t, NodeId{1}, b))
+	if len(s.Servers) != 2 || s.Departed != 0 {
+		t.Fatal("Goodbye from wrong address accepted.")
+	}
+	s.goodbyeHandler(goodbyeRequest(t, NodeId{1}, a))
+	if len(s.Servers) != 1 || s.Departed != 1 {
+		t.Fatal("Server not removed.", len(s.Servers))
+	}
+	// Clients keep the center.
+	s.goodbyeHandler(goodbyeRequest(t, NodeId{2}, b))
+	if len(s.Servers) != 1 || s.Departed != 1 {
+		t.Fatal("Center removed.")
+	}
+}
+
+func TestSleep(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	if !sleep(ctx, time.Millisecond) {
+		t.Fatal("Sleep cancelled.")
+	}
+	cancel()
+	start := time.Now()
+	if sleep(ctx, time.Hour) || time.Since(start) > time.Second {
+		t.Fatal("Sleep not cancelled.")
+	}
+}
+
+func TestGoodbyeOldVersion(t *testing.T) {
+	if _, err := DecodeGoodbye(&Header{Version: ClockVersion}, make([]byte, GoodbyePackageLength)); err == nil {
+		t.Fatal("Goodbye accepted before GoodbyeVersion.")
+	}
+}
@@ -0,0 +1,63 @@
+package udp
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// MaxPendingProbes bounds the probe requests waiting for the same target.
+const MaxPendingProbes = 16
+
+// pendingProbe is a probe request waiting for the echo reply of its target.
+type pendingProbe struct {
+	connection PacketWriter
+	address    *net.UDPAddr
+	requester  *RemoteServer
+	since      time.Time
+}
+
+// ProbePackage names the peer Target in probe requests, which ask another
+// peer to probe it, and carries the view of that peer on Target in probe
+// replies.
+type ProbePackage struct {
+	Target ServerInfo
+}
+
+func (s *ProbePackage) ToData(header *Header) []byte {
+	data, start := header.ToData(s.Target.length(header.Version))
+	s.Target.toData(header.Version, data[start:])
+	return header.Seal(data)
+}
+
+func (s *ProbePackage) LoadFromData(header *Header, data []byte) error {
+	if header.Version < GossipVersion {
+		return errors.New("Wrong package version.")
+	}
+	length, err := s.Target.loadFromData(header.Version, data)
+	if err != nil {
+		return err
+	}
+	if length != len(data) {
+		return errors.New("Wrong package size.")
+	}
+	return nil
+}
+
+// DecodeProbe is the codec of probe requests and replies.
+func DecodeProbe(header *Header, payload []byte) (interface{}, error) {
+	p := &ProbePackage{}
+	if err := p.LoadFromData(header, payload); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// DecodeGossip is the codec of gossip packages, which are sync packages
+// exchanged between peers.
+func DecodeGossip(header *Header, payload []byte) (interface{}, error) {
+	if header.Version < GossipVersion {
+		return nil, errors.New("Wrong package version.")
+	}
+	return DecodeSync(header, payload)
+}
@@ -0,0 +1,243 @@
+package udp
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"github.com/Catofes/go-its/config"
+)
+
+func probeRequest(t *testing.T, packageType byte, target ServerInfo, connection *net.UDPConn, address *net.UDPAddr) *Request {
+	data := (&ProbePackage{target}).ToData(NewHeader(packageType, ProtocolVersion, 0))
+	header, payload, err := LoadHeader(data)
+	if err != nil {
+		t.Fatal("Load probe failed.", err)
+	}
+	message, err := DecodeProbe(header, payload)
+	if err != nil {
+		t.Fatal("Decode probe failed.", err)
+	}
+	return &Request{connection, address, header, payload, message}
+}
+
+func TestProbeParser(t *testing.T) {
+	target := ServerInfo{Ip: net.ParseIP("10.0.0.2"), Port: 2000, LastOnline: 42, NodeId: NodeId{2}}
+	r := probeRequest(t, PackageTypeProbeReply, target, nil, nil)
+	got := r.Message.(*ProbePackage).Target
+	if !got.Ip.Equal(target.Ip) || got.Port != target.Port || got.LastOnline != 42 || got.NodeId != target.NodeId {
+		t.Fatal("Probe differs.", got)
+	}
+	if _, err := DecodeProbe(r.Header, append(r.Payload, 0)); err == nil {
+		t.Fatal("Probe with trailing bytes accepted.")
+	}
+	if _, err := DecodeProbe(&Header{Version: LeaseVersion}, r.Payload); err == nil {
+		t.Fatal("Probe accepted before GossipVersion.")
+	}
+	if _, err := DecodeGossip(&Header{Version: LeaseVersion}, nil); err == nil {
+		t.Fatal("Gossip accepted before GossipVersion.")
+	}
+}
+
+func TestGossipHandler(t *testing.T) {
+	udpService = &UdpService{isServer: false}
+	defer func() { udpService = nil }()
+	s := &MainService{Servers: make(map[string]*RemoteServer), maxAge: time.Minute,
+		node: NodeInfo{NodeId{9}, "self", nil}}
+	s.reassembler = (&Reassembler{}).Init(time.Second)
+	address := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+
+	p := (&SyncPackage{}).Init()
+	p.Self = ServerInfo{Ip: net.ParseIP("10.0.0.9"), Port: 9000}
+	p.Node = NodeInfo{NodeId{1}, "sender", nil}
+	p.Servers.Push(&ServerInfo{Ip: net.ParseIP("10.0.0.2"), Port: 2000, LastOnline: 42, NodeId: NodeId{2}, Version: ProtocolVersion})
+	p.Servers.Push(&ServerInfo{Ip: net.ParseIP("10.0.0.3"), Port: 3000, NodeId: NodeId{3}, Removed: true})
+	p.Servers.Push(&ServerInfo{Ip: net.ParseIP("10.0.0.9"), Port: 9000, NodeId: NodeId{9}})
+	d, _ := p.ToData(NewHeader(PackageTypeGossip, ProtocolVersion, 0))
+	header, payload, err := LoadHeader(d[0])
+	if err != nil {
+		t.Fatal("Load gossip failed.", err)
+	}
+	message, err := DecodeGossip(header, payload)
+	if err != nil {
+		t.Fatal("Decode gossip failed.", err)
+	}
+	s.gossipHandler(&Request{nil, address, header, payload, message})
+
+	sender, ok := s.Servers[(&RemoteServer{NodeId: NodeId{1}}).key()]
+	if !ok || len(s.Servers) != 2 || !s.ip.Equal(net.ParseIP("10.0.0.9")) {
+		t.Fatal("Error gossiped servers.", len(s.Servers))
+	}
+	if _, ok := s.Servers[(&RemoteServer{NodeId: NodeId{2}}).key()]; !ok {
+		t.Fatal("Gossiped server not added.")
+	}
+	if v, ok := sender.ServerInfo[(&RemoteServer{NodeId: NodeId{2}}).key()]; !ok || v.LastOnline != 42 || len(sender.ServerInfo) != 2 {
+		t.Fatal("View of sender not recorded.", sender.ServerInfo)
+	}
+	if peers := s.gossipPeers(5, sender); len(peers) != 1 || peers[0].NodeId != (NodeId{2}) {
+		t.Fatal("Error gossip peers.", peers)
+	}
+}
+
+// echoReply answers the echo request in payload as its target would.
+func echoReply(t *testing.T, header *Header, payload []byte) []byte {
+	message, err := DecodeEcho(header, payload)
+	if err != nil {
+		t.Fatal("Decode echo failed.", err)
+	}
+	echo := message.(*EchoPackage)
+	echo.ReceiveTimestamp = time.Now().UnixNano()
+	echo.ReplyTimestamp = echo.ReceiveTimestamp
+	return echo.ToData(NewHeader(PackageTypeEchoReply, header.Version, header.Capabilities))
+}
+
+func TestIndirectProbe(t *testing.T) {
+	listen := func() *net.UDPConn {
+		connection, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Skip("Can't listen udp.", err)
+		}
+		return connection
+	}
+	self, requester, target := listen(), listen(), listen()
+	defer self.Close()
+	defer requester.Close()
+	defer target.Close()
+	requesterAddress := requester.LocalAddr().(*net.UDPAddr)
+	targetAddress := target.LocalAddr().(*net.UDPAddr)
+
+	s := &MainService{Servers: make(map[string]*RemoteServer), maxAge: time.Minute}
+	for i, address := range []*net.UDPAddr{requesterAddress, targetAddress} {
+		v := (&RemoteServer{}).Init(address.IP, uint16(address.Port))
+		v.NodeId = NodeId{byte(i + 1)}
+		v.LastOnline = time.Unix(0, 42)
+		s.Servers[v.key()] = v
+	}
+	query := ServerInfo{Ip: targetAddress.IP, Port: uint16(targetAddress.Port), NodeId: NodeId{2}}
+	s.probeRequestHandler(probeRequest(t, PackageTypeProbeRequest, query, self, requesterAddress))
+
+	buffer := make([]byte, 1024)
+	target.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := target.ReadFromUDP(buffer)
+	if err != nil || buffer[2] != PackageTypeEchoRequest {
+		t.Fatal("Target not pinged.", n, err)
+	}
+	// Nothing is answered before the target replied.
+	requester.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := requester.ReadFromUDP(buffer); err == nil {
+		t.Fatal("Answered before the target replied.")
+	}
+	header, payload, _ := LoadHeader(buffer[:n])
+	header, payload, _ = LoadHeader(echoReply(t, header, payload))
+	message, _ := DecodeEcho(header, payload)
+	s.echoReplyHandler(&Request{self, targetAddress, header, payload, message})
+
+	requester.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err = requester.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal("Read probe reply failed.", err)
+	}
+	header, payload, err = LoadHeader(buffer[:n])
+	if err != nil || header.Type != PackageTypeProbeReply {
+		t.Fatal("Load probe reply failed.", err)
+	}
+	message, err = DecodeProbe(header, payload)
+	if err != nil || message.(*ProbePackage).Target.LastOnline <= 42 {
+		t.Fatal("Error probe reply.", err)
+	}
+
+	// Probes whose target replied too late aren't answered.
+	old := lossTimeout
+	lossTimeout = 0
+	defer func() { lossTimeout = old }()
+	s.probeRequestHandler(probeRequest(t, PackageTypeProbeRequest, query, self, requesterAddress))
+	target.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, _ = target.ReadFromUDP(buffer)
+	h, p, _ := LoadHeader(buffer[:n])
+	h, p, _ = LoadHeader(echoReply(t, h, p))
+	echo, _ := DecodeEcho(h, p)
+	s.echoReplyHandler(&Request{self, targetAddress, h, p, echo})
+	requester.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := requester.ReadFromUDP(make([]byte, 1024)); err == nil {
+		t.Fatal("Answered a late reply.")
+	}
+
+	// The requester records the view of the server it asked.
+	asked := (&RemoteServer{}).Init(self.LocalAddr().(*net.UDPAddr).IP, uint16(self.LocalAddr().(*net.UDPAddr).Port))
+	r := &MainService{Servers: map[string]*RemoteServer{"asked": asked}, maxAge: time.Minute}
+	r.probeReplyHandler(&Request{requester, self.LocalAddr().(*net.UDPAddr), header, payload, message})
+	if v, ok := asked.ServerInfo[(&RemoteServer{NodeId: NodeId{2}}).key()]; !ok || v.LastOnline != message.(*ProbePackage).Target.LastOnline {
+		t.Fatal("Probe reply not recorded.")
+	}
+}
+
+func TestEncryptedGossip(t *testing.T) {
+	if err := SetEncryptKeys([]string{strings.Repeat("11", 32)}); err != nil {
+		t.Fatal("Set keys failed.", err)
+	}
+	defer SetEncryptKeys(nil)
+	file := filepath.Join(t.TempDir(), "config.json")
+	ioutil.WriteFile(file, []byte(`{"Token": 123}`), 0600)
+	config.GetInstance(file)
+	listen := func() *net.UDPConn {
+		connection, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Skip("Can't listen udp.", err)
+		}
+		return connection
+	}
+	a, b := listen(), listen()
+	defer a.Close()
+	defer b.Close()
+	defer func() { udpService = nil }()
+	service := func(id byte, peer *net.UDPAddr, peerId byte) (*MainService, *RemoteServer) {
+		s := &MainService{Servers: make(map[string]*RemoteServer), maxAge: time.Minute, node: NodeInfo{NodeId{id}, "", nil}}
+		s.reassembler = (&Reassembler{}).Init(time.Second)
+		v := (&RemoteServer{}).Init(peer.IP, uint16(peer.Port))
+		v.NodeId = NodeId{peerId}
+		s.Servers[v.key()] = v
+		return s, v
+	}
+	sa, b1 := service(1, b.LocalAddr().(*net.UDPAddr), 2)
+	sb, a1 := service(2, a.LocalAddr().(*net.UDPAddr), 1)
+	// Each side also gossips about a third peer, whose view changes each
+	// round.
+	other := (&RemoteServer{}).Init(net.ParseIP("10.0.0.3"), 3000)
+	other.NodeId = NodeId{3}
+	sa.Servers[other.key()] = other
+
+	gossip := func(from *net.UDPConn, s *MainService, to *RemoteServer, at *net.UDPConn, r *MainService) {
+		udpService = &UdpService{connection: from}
+		s.gossipTo(to)
+		buffer := make([]byte, 2048)
+		at.SetReadDeadline(time.Now().Add(time.Second))
+		n, addr, err := at.ReadFromUDP(buffer)
+		if err != nil {
+			t.Fatal("Read gossip failed.", err)
+		}
+		header, payload, err := LoadHeader(buffer[:n])
+		if err != nil || !header.Encrypted {
+			t.Fatal("Gossip not encrypted.", err)
+		}
+		message, err := DecodeGossip(header, payload)
+		if err != nil {
+			t.Fatal("Decode gossip failed.", err)
+		}
+		udpService = &UdpService{connection: at}
+		r.gossipHandler(&Request{at, addr, header, payload, message})
+	}
+	for i := 1; i <= 3; i++ {
+		other.LastOnline = time.Unix(0, int64(i))
+		gossip(a, sa, b1, b, sb)
+		gossip(b, sb, a1, a, sa)
+		sender := sb.Servers[(&RemoteServer{NodeId: NodeId{1}}).key()]
+		if sender == nil {
+			t.Fatal("Gossip dropped.", i)
+		}
+		if v := sender.ServerInfo[other.key()]; v == nil || v.LastOnline != uint64(i) {
+			t.Fatal("Gossip of round dropped.", i)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package udp
+
+import (
+	"sort"
+	"sync"
+)
+
+// LatencyStats keeps statistics over the last round trips of a peer, all in
+// nanoseconds. Jitter is the RFC 3550 interarrival jitter applied to round
+// trips, EWMA smooths with the TCP SRTT gain of 1/8.
+type LatencyStats struct {
+	Min    int64
+	Avg    int64
+	Max    int64
+	P50    int64
+	P95    int64
+	P99    int64
+	Jitter int64
+	EWMA   int64
+	Count  int
+	jitter int64
+	window []int64
+	next   int
+	last   int64
+	mutex  sync.Mutex
+}
+
+func (s *LatencyStats) Init(size int) *LatencyStats {
+	if size < 1 {
+		size = 1
+	}
+	s.window = make([]int64, 0, size)
+	return s
+}
+
+func percentile(sorted []int64, p int) int64 {
+	return sorted[(len(sorted)-1)*p/100]
+}
+
+func (s *LatencyStats) Add(rtt int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.window) < cap(s.window) {
+		s.window = append(s.window, rtt)
+	} else {
+		s.window[s.next] = rtt
+		s.next = (s.next + 1) % cap(s.window)
+	}
+	if s.Count == 0 {
+		s.EWMA = rtt
+	} else {
+		d := rtt - s.last
+		if d < 0 {
+			d = -d
+		}
+		// Kept scaled by 16 as in RFC 3550 A.8, so small deltas are not lost.
+		s.jitter += d - ((s.jitter + 8) >> 4)
+		s.Jitter = s.jitter >> 4
+		s.EWMA += (rtt - s.EWMA) / 8
+	}
+	s.last = rtt
+	s.Count++
+
+	sorted := make([]int64, len(s.window))
+	copy(sorted, s.window)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	sum := int64(0)
+	for _, v := range sorted {
+		sum += v
+	}
+	s.Min = sorted[0]
+	s.Max = sorted[len(sorted)-1]
+	s.Avg = sum / int64(len(sorted))
+	s.P50 = percentile(sorted, 50)
+	s.P95 = percentile(sorted, 95)
+	s.P99 = percentile(sorted, 99)
+}
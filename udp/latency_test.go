@@ -0,0 +1,27 @@
+package udp
+
+import "testing"
+
+func TestLatencyStats(t *testing.T) {
+	s := (&LatencyStats{}).Init(100)
+	for i := int64(1); i <= 200; i++ {
+		s.Add(i)
+	}
+	if s.Min != 101 || s.Max != 200 || s.Avg != 150 || s.Count != 200 {
+		t.Fatal("Error window.", s.Min, s.Max, s.Avg, s.Count)
+	}
+	if s.P50 != 150 || s.P95 != 195 || s.P99 != 199 {
+		t.Fatal("Error percentiles.", s.P50, s.P95, s.P99)
+	}
+	if s.EWMA < 190 || s.EWMA > 200 {
+		t.Fatal("Error EWMA.", s.EWMA)
+	}
+
+	s = (&LatencyStats{}).Init(10)
+	for i := 0; i < 1000; i++ {
+		s.Add(int64(100 + (i%2)*32))
+	}
+	if s.Jitter < 30 || s.Jitter > 32 || s.Avg != 116 {
+		t.Fatal("Error jitter.", s.Jitter, s.Avg)
+	}
+}
@@ -0,0 +1,178 @@
+package udp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// LeasePackageLength is the payload size of a lease package.
+const LeasePackageLength = 12 + NodeIdLength
+
+// LeasePackage announces the leader of the centers. The leader sends it to
+// the other centers and the clients every sync, Lease is how many
+// milliseconds the leadership lasts without a renewal. The other centers
+// send it back to the leader as their acknowledgement.
+type LeasePackage struct {
+	Term   uint64
+	Leader NodeId
+	Lease  uint32
+}
+
+func (s *LeasePackage) ToData(header *Header) []byte {
+	data, start := header.ToData(LeasePackageLength)
+	binary.BigEndian.PutUint64(data[start:start+8], s.Term)
+	copy(data[start+8:start+8+NodeIdLength], s.Leader[:])
+	binary.BigEndian.PutUint32(data[start+8+NodeIdLength:start+LeasePackageLength], s.Lease)
+	return header.Seal(data)
+}
+
+func (s *LeasePackage) LoadFromData(header *Header, data []byte) error {
+	if header.Version < LeaseVersion || len(data) != LeasePackageLength {
+		return errors.New("Wrong package size.")
+	}
+	s.Term = binary.BigEndian.Uint64(data[0:8])
+	copy(s.Leader[:], data[8:8+NodeIdLength])
+	s.Lease = binary.BigEndian.Uint32(data[8+NodeIdLength:])
+	if s.Leader.IsZero() {
+		return errors.New("Lease without leader.")
+	}
+	return nil
+}
+
+// DecodeLease is the codec of lease packages.
+func DecodeLease(header *Header, payload []byte) (interface{}, error) {
+	p := &LeasePackage{}
+	if err := p.LoadFromData(header, payload); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Election tracks the leader of the centers. Leadership is a lease the
+// leader renews every sync. A candidate takes over once the lease expired,
+// in a new term. Leases of a higher term win, and of two leaders in the same
+// term the one with the lower node id. Clients only observe the election.
+//
+// A leader only leads while a majority of the centers, itself included,
+// acknowledged its lease within the last lease time. So of two sides of a
+// partition at most one leads, and none if no side holds a majority: with
+// two centers, losing one stops the gateway management, three centers
+// survive losing one. Centers which said goodbye don't count until they are
+// heard from again.
+type Election struct {
+	Term      uint64
+	Leader    NodeId
+	Until     time.Time
+	self      NodeId
+	lease     time.Duration
+	candidate bool
+	centers   int
+	acks      map[NodeId]time.Time
+	departed  map[NodeId]bool
+}
+
+// Init starts an election between centers centers. A candidate with peers
+// waits one lease for the current leader before it takes over, one without
+// takes over at once.
+func (s *Election) Init(self NodeId, lease time.Duration, candidate bool, centers int, now time.Time) *Election {
+	s.self = self
+	s.lease = lease
+	s.candidate = candidate
+	s.centers = centers
+	s.acks = make(map[NodeId]time.Time)
+	s.departed = make(map[NodeId]bool)
+	if centers > 1 {
+		s.Until = now.Add(lease)
+	} else {
+		s.Until = now
+	}
+	return s
+}
+
+// IsLeader tells if this center holds the lease, acknowledged by a majority
+// of the centers.
+func (s *Election) IsLeader(now time.Time) bool {
+	return s.candidate && s.Leader == s.self && now.Before(s.Until) && s.quorum(now)
+}
+
+// quorum tells if a majority of the centers still present acknowledged the
+// current lease.
+func (s *Election) quorum(now time.Time) bool {
+	acks := 1
+	for id, t := range s.acks {
+		if !s.departed[id] && now.Sub(t) < s.lease {
+			acks++
+		}
+	}
+	return acks > (s.centers-len(s.departed))/2
+}
+
+// Ack records that the center id acknowledged the lease of term.
+func (s *Election) Ack(id NodeId, term uint64, now time.Time) {
+	delete(s.departed, id)
+	if term == s.Term && s.Leader == s.self && id != s.self {
+		s.acks[id] = now
+	}
+}
+
+// Trusts tells if the center id leads, or nobody is known to lead.
+func (s *Election) Trusts(id NodeId, now time.Time) bool {
+	return s.Leader.IsZero() || !now.Before(s.Until) || s.Leader == id
+}
+
+// Tick renews the lease of the leader, or takes over an expired one. It
+// returns the lease to announce, or nil.
+func (s *Election) Tick(now time.Time) *LeasePackage {
+	if !s.candidate {
+		return nil
+	}
+	if s.Leader != s.self {
+		if now.Before(s.Until) {
+			return nil
+		}
+		s.Term++
+		s.Leader = s.self
+		s.acks = make(map[NodeId]time.Time)
+		log.Warning("Take over as leader in term %d.", s.Term)
+	}
+	s.Until = now.Add(s.lease)
+	return &LeasePackage{s.Term, s.self, uint32(s.lease / time.Millisecond)}
+}
+
+// Observe applies a lease announced by a leader, it returns false for
+// leases which lost.
+func (s *Election) Observe(p *LeasePackage, now time.Time) bool {
+	if p.Term < s.Term {
+		return false
+	}
+	if p.Term == s.Term && p.Leader != s.Leader && !s.Leader.IsZero() && now.Before(s.Until) &&
+		bytes.Compare(p.Leader[:], s.Leader[:]) > 0 {
+		return false
+	}
+	delete(s.departed, p.Leader)
+	if s.Leader != p.Leader {
+		s.acks = make(map[NodeId]time.Time)
+		if s.Leader == s.self && s.candidate {
+			log.Warning("Step down for leader %s in term %d.", p.Leader.String(), p.Term)
+		} else {
+			log.Warning("Follow leader %s in term %d.", p.Leader.String(), p.Term)
+		}
+	}
+	s.Term = p.Term
+	s.Leader = p.Leader
+	s.Until = now.Add(time.Duration(p.Lease) * time.Millisecond)
+	return true
+}
+
+// Resign ends the lease of the leader id at once and leaves it out of the
+// majority, e.g. when it shuts down.
+func (s *Election) Resign(id NodeId, now time.Time) {
+	if id != s.self && len(s.departed) < s.centers-1 {
+		s.departed[id] = true
+	}
+	if s.Leader == id && now.Before(s.Until) {
+		s.Until = now
+	}
+}
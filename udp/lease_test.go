@@ -0,0 +1,250 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+	"github.com/Catofes/go-its/config"
+)
+
+func TestLeaseParser(t *testing.T) {
+	p := LeasePackage{Term: 7, Leader: NodeId{1, 2}, Lease: 6000}
+	header, payload, err := LoadHeader(p.ToData(NewHeader(PackageTypeLease, ProtocolVersion, 0)))
+	if err != nil {
+		t.Fatal("Load lease failed.", err)
+	}
+	message, err := DecodeLease(header, payload)
+	if err != nil || *message.(*LeasePackage) != p {
+		t.Fatal("Decode lease failed.", err)
+	}
+	if _, err := DecodeLease(&Header{Version: ParametersVersion}, payload); err == nil {
+		t.Fatal("Lease accepted before LeaseVersion.")
+	}
+	if _, err := DecodeLease(header, make([]byte, LeasePackageLength)); err == nil {
+		t.Fatal("Lease without leader accepted.")
+	}
+}
+
+func TestElection(t *testing.T) {
+	now := time.Now()
+	a := (&Election{}).Init(NodeId{1}, time.Second, true, 2, now)
+	b := (&Election{}).Init(NodeId{2}, time.Second, true, 2, now)
+	if a.Tick(now) != nil || a.IsLeader(now) {
+		t.Fatal("Took over before the lease expired.")
+	}
+
+	// Both take over in the same term, the lower node id wins once the
+	// other center acknowledged its lease.
+	now = now.Add(time.Second)
+	la, lb := a.Tick(now), b.Tick(now)
+	if la == nil || lb == nil || la.Term != 1 || lb.Term != 1 {
+		t.Fatal("No take over.", la, lb)
+	}
+	if b.Observe(la, now) != true || b.IsLeader(now) || b.Leader != a.self {
+		t.Fatal("Higher node id didn't step down.")
+	}
+	if a.Observe(lb, now) || a.IsLeader(now) {
+		t.Fatal("Lead without a majority.")
+	}
+	if a.Ack(b.self, la.Term, now); !a.IsLeader(now) {
+		t.Fatal("Lower node id stepped down.")
+	}
+
+	// The leader renews, the follower waits.
+	now = now.Add(500 * time.Millisecond)
+	if b.Observe(a.Tick(now), now); b.Tick(now.Add(900*time.Millisecond)) != nil {
+		t.Fatal("Follower took over a renewed lease.")
+	}
+	// Without acknowledgements the leader keeps renewing, but stops leading.
+	if a.Tick(now.Add(600*time.Millisecond)) == nil || a.IsLeader(now.Add(600*time.Millisecond)) {
+		t.Fatal("Lead without acknowledgements.")
+	}
+
+	// The follower takes over once the leader went quiet, and the old
+	// leader follows the higher term.
+	now = now.Add(1500 * time.Millisecond)
+	lb = b.Tick(now)
+	if lb == nil || lb.Term != 2 || b.IsLeader(now) {
+		t.Fatal("Follower didn't take over.", lb)
+	}
+	if a.IsLeader(now) || !a.Observe(lb, now) || a.Leader != b.self {
+		t.Fatal("Old leader didn't follow.")
+	}
+	if b.Ack(a.self, 1, now); b.IsLeader(now) {
+		t.Fatal("Acknowledgement of an old term counted.")
+	}
+	if b.Ack(a.self, 2, now); !b.IsLeader(now) {
+		t.Fatal("Follower doesn't lead.")
+	}
+	if b.Observe(&LeasePackage{1, NodeId{1}, 1000}, now) {
+		t.Fatal("Lease of an old term accepted.")
+	}
+
+	// A leaving leader is replaced at once, and no longer counts.
+	a.Resign(b.self, now)
+	if la = a.Tick(now); la == nil || la.Term != 3 || !a.IsLeader(now) {
+		t.Fatal("No take over after resign.", la)
+	}
+
+	// Of three centers, one alone never leads.
+	c := (&Election{}).Init(NodeId{6}, time.Second, true, 3, now)
+	now = now.Add(time.Second)
+	if c.Tick(now) == nil || c.IsLeader(now) {
+		t.Fatal("Minority leads.")
+	}
+	if c.Ack(NodeId{7}, c.Term, now); !c.IsLeader(now) {
+		t.Fatal("Majority doesn't lead.")
+	}
+
+	// A single center leads at once, clients never lead.
+	single := (&Election{}).Init(NodeId{3}, time.Second, true, 1, now)
+	if single.Tick(now) == nil || !single.IsLeader(now) {
+		t.Fatal("Single center doesn't lead.")
+	}
+	client := (&Election{}).Init(NodeId{4}, time.Second, false, 2, now)
+	if client.Tick(now.Add(time.Hour)) != nil || !client.Trusts(NodeId{5}, now) {
+		t.Fatal("Error client election.")
+	}
+	client.Observe(la, now)
+	if client.Trusts(NodeId{5}, now) || !client.Trusts(a.self, now) || !client.Trusts(NodeId{5}, now.Add(time.Hour)) {
+		t.Fatal("Error trusted centers.")
+	}
+}
+
+func leaseRequest(t *testing.T, packageType byte, p LeasePackage, address *net.UDPAddr) *Request {
+	header, payload, err := LoadHeader(p.ToData(NewHeader(packageType, ProtocolVersion, 0)))
+	if err != nil {
+		t.Fatal("Load lease failed.", err)
+	}
+	message, _ := DecodeLease(header, payload)
+	return &Request{nil, address, header, payload, message}
+}
+
+func TestLeaseHandler(t *testing.T) {
+	udpService = &UdpService{isServer: false}
+	defer func() { udpService = nil }()
+	a := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	b := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2000}
+	s := &MainService{Servers: make(map[string]*RemoteServer), maxAge: time.Minute}
+	s.election = (&Election{}).Init(NodeId{9}, time.Second, false, 2, time.Now())
+	for i, address := range []*net.UDPAddr{a, b} {
+		v := (&RemoteServer{}).Init(address.IP, uint16(address.Port))
+		v.NodeId = NodeId{byte(i + 1)}
+		v.Center = i == 0
+		s.Servers[v.key()] = v
+	}
+
+	// Only a center announces its own lease.
+	s.leaseHandler(leaseRequest(t, PackageTypeLease, LeasePackage{1, NodeId{2}, 1000}, b))
+	s.leaseHandler(leaseRequest(t, PackageTypeLease, LeasePackage{1, NodeId{2}, 1000}, a))
+	if !s.election.Leader.IsZero() {
+		t.Fatal("Lease of another server accepted.")
+	}
+	s.leaseHandler(leaseRequest(t, PackageTypeLease, LeasePackage{1, NodeId{1}, 1000}, a))
+	if s.election.Leader != (NodeId{1}) || s.election.Term != 1 {
+		t.Fatal("Lease not applied.", s.election)
+	}
+}
+
+func TestLeaseAckHandler(t *testing.T) {
+	udpService = &UdpService{isServer: true}
+	defer func() { udpService = nil }()
+	a := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	b := &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 2000}
+	now := time.Now()
+	s := &MainService{Servers: make(map[string]*RemoteServer), maxAge: time.Minute, node: NodeInfo{NodeId{9}, "self", nil}}
+	s.election = (&Election{}).Init(NodeId{9}, time.Second, true, 3, now.Add(-time.Second))
+	for i, address := range []*net.UDPAddr{a, b} {
+		v := (&RemoteServer{}).Init(address.IP, uint16(address.Port))
+		v.NodeId = NodeId{byte(i + 1)}
+		v.Center = i == 0
+		s.Servers[v.key()] = v
+	}
+	lease := s.election.Tick(now)
+
+	// Only centers acknowledge, and only leases of this center.
+	s.leaseAckHandler(leaseRequest(t, PackageTypeLeaseAck, *lease, b))
+	s.leaseAckHandler(leaseRequest(t, PackageTypeLeaseAck, LeasePackage{lease.Term, NodeId{1}, 1000}, a))
+	if s.election.IsLeader(time.Now()) {
+		t.Fatal("Lead without a majority.")
+	}
+	s.leaseAckHandler(leaseRequest(t, PackageTypeLeaseAck, *lease, a))
+	if !s.election.IsLeader(time.Now()) {
+		t.Fatal("Acknowledgement not counted.")
+	}
+}
+
+func TestTrustedParameters(t *testing.T) {
+	udpService = &UdpService{isServer: false}
+	defer func() { udpService = nil }()
+	s := &MainService{Servers: make(map[string]*RemoteServer), maxAge: time.Minute, pingEvery: time.Second}
+	s.reassembler = (&Reassembler{}).Init(time.Second)
+	s.election = (&Election{}).Init(NodeId{9}, time.Minute, false, 2, time.Now())
+	addresses := []*net.UDPAddr{{IP: net.ParseIP("10.0.0.1"), Port: 1000}, {IP: net.ParseIP("10.0.0.2"), Port: 2000}}
+	for i, address := range addresses {
+		v := (&RemoteServer{}).Init(address.IP, uint16(address.Port))
+		v.NodeId = NodeId{byte(i + 1)}
+		v.Center = true
+		s.Servers[v.key()] = v
+	}
+	s.election.Observe(&LeasePackage{1, NodeId{1}, 60000}, time.Now())
+	sync := func(i int, pingEvery uint32) {
+		p := (&SyncPackage{}).Init()
+		p.Self = ServerInfo{Ip: net.ParseIP("10.0.0.9"), Port: 9000}
+		p.Node = NodeInfo{NodeId{byte(i + 1)}, "center", nil}
+		p.Parameters = Parameters{PingEvery: pingEvery}
+		d, _ := p.ToData(NewHeader(PackageTypeSync, ProtocolVersion, 0))
+		header, payload, _ := LoadHeader(d[0])
+		header.Authenticated = true
+		message, err := DecodeSync(header, payload)
+		if err != nil {
+			t.Fatal("Decode sync failed.", err)
+		}
+		s.syncHandler(&Request{nil, addresses[i], header, payload, message})
+	}
+
+	// Only the leader sets the parameters.
+	sync(1, 300)
+	if s.pingEvery != time.Second {
+		t.Fatal("Parameters of a follower applied.", s.pingEvery)
+	}
+	sync(0, 400)
+	if s.pingEvery != 400*time.Millisecond {
+		t.Fatal("Parameters of the leader not applied.", s.pingEvery)
+	}
+}
+
+func TestLegacySingleCenter(t *testing.T) {
+	defer func() { udpService = nil }()
+	legacy := &config.MainConfig{CenterServerAddress: "10.0.0.1", ListenPort: 5000}
+
+	// A center configured the way it was before Centers leads alone.
+	udpService = &UdpService{isServer: true}
+	s := &MainService{Servers: make(map[string]*RemoteServer), ip: net.ParseIP("10.0.0.1")}
+	centers := s.addCenters(legacy)
+	if centers != 1 || len(s.Servers) != 0 {
+		t.Fatal("Center counts itself.", centers, len(s.Servers))
+	}
+	now := time.Now()
+	election := (&Election{}).Init(NodeId{1}, time.Second, true, centers, now)
+	now = now.Add(time.Second)
+	if election.Tick(now) == nil || !election.IsLeader(now) {
+		t.Fatal("Single center doesn't lead.")
+	}
+
+	// Its clients still sync with it.
+	udpService = &UdpService{isServer: false}
+	s = &MainService{Servers: make(map[string]*RemoteServer)}
+	if centers := s.addCenters(legacy); centers != 1 || len(s.Servers) != 1 {
+		t.Fatal("Client lost the center.", centers, len(s.Servers))
+	}
+
+	// Centers on one host are told apart by port.
+	udpService = &UdpService{isServer: true}
+	s = &MainService{Servers: make(map[string]*RemoteServer), ip: net.ParseIP("10.0.0.1")}
+	both := &config.MainConfig{CenterServerAddress: "10.0.0.1", ListenPort: 5000,
+		Centers: []config.NodeAddress{{Address: "10.0.0.1", Port: 5000}, {Address: "10.0.0.1", Port: 5002}}}
+	if centers := s.addCenters(both); centers != 2 || len(s.Servers) != 1 {
+		t.Fatal("Error centers.", centers, len(s.Servers))
+	}
+}
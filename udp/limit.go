@@ -0,0 +1,149 @@
+package udp
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MaxRateBuckets bounds the sources the rate limiter tracks. When it is
+// reached, sources with a full bucket are forgotten; if none are, packages
+// from new sources are limited until some are.
+const MaxRateBuckets = 4096
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter allows each source Rate packages per second with bursts of
+// up to Burst packages.
+type RateLimiter struct {
+	Rate    float64
+	Burst   float64
+	buckets map[string]*tokenBucket
+	mutex   sync.Mutex
+}
+
+func (s *RateLimiter) Init(rate float64, burst float64) *RateLimiter {
+	s.Rate = rate
+	s.Burst = burst
+	s.buckets = make(map[string]*tokenBucket)
+	return s
+}
+
+func (s *RateLimiter) Allow(ip net.IP, now time.Time) bool {
+	if s.Rate <= 0 {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	key := string(ip.To16())
+	bucket, ok := s.buckets[key]
+	if !ok {
+		if len(s.buckets) >= MaxRateBuckets && !s.sweep(now) {
+			return false
+		}
+		bucket = &tokenBucket{s.Burst, now}
+		s.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * s.Rate
+	if bucket.tokens > s.Burst {
+		bucket.tokens = s.Burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// sweep forgets the sources whose bucket would be full by now.
+func (s *RateLimiter) sweep(now time.Time) bool {
+	for k, v := range s.buckets {
+		if v.tokens+now.Sub(v.last).Seconds()*s.Rate >= s.Burst {
+			delete(s.buckets, k)
+		}
+	}
+	return len(s.buckets) < MaxRateBuckets
+}
+
+// AccessList permits sources not in Deny, and when Allow is not empty only
+// the sources in Allow.
+type AccessList struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+// ParseNetworks parses addresses or CIDR networks.
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: v}
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			result = append(result, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, network)
+	}
+	return result, nil
+}
+
+func (s *AccessList) Permit(ip net.IP) bool {
+	for _, v := range s.Deny {
+		if v.Contains(ip) {
+			return false
+		}
+	}
+	if len(s.Allow) == 0 {
+		return true
+	}
+	for _, v := range s.Allow {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// DropCounters counts the packages dropped by the listener and handlers.
+type DropCounters struct {
+	Denied          uint64
+	RateLimited     uint64
+	Malformed       uint64
+	Unauthenticated uint64
+	UnknownPeer     uint64
+	UnknownType     uint64
+}
+
+var drops DropCounters
+
+func countDrop(counter *uint64) {
+	atomic.AddUint64(counter, 1)
+}
+
+// Drops returns a copy of the drop counters.
+func Drops() DropCounters {
+	return DropCounters{
+		Denied:          atomic.LoadUint64(&drops.Denied),
+		RateLimited:     atomic.LoadUint64(&drops.RateLimited),
+		Malformed:       atomic.LoadUint64(&drops.Malformed),
+		Unauthenticated: atomic.LoadUint64(&drops.Unauthenticated),
+		UnknownPeer:     atomic.LoadUint64(&drops.UnknownPeer),
+		UnknownType:     atomic.LoadUint64(&drops.UnknownType),
+	}
+}
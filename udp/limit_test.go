@@ -0,0 +1,138 @@
+package udp
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	s := (&RateLimiter{}).Init(10, 3)
+	a, b := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if !s.Allow(a, now) {
+			t.Fatal("Burst limited.", i)
+		}
+	}
+	if s.Allow(a, now) {
+		t.Fatal("Burst exceeded.")
+	}
+	if !s.Allow(b, now) {
+		t.Fatal("Sources share a bucket.")
+	}
+	if !s.Allow(a, now.Add(100*time.Millisecond)) || s.Allow(a, now.Add(100*time.Millisecond)) {
+		t.Fatal("Error refill.")
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	s := (&RateLimiter{}).Init(1, 1)
+	now := time.Now()
+	ip := make(net.IP, net.IPv4len)
+	for i := 0; i < MaxRateBuckets; i++ {
+		binary.BigEndian.PutUint32(ip, uint32(i))
+		s.Allow(ip, now)
+	}
+	if s.Allow(net.ParseIP("192.168.0.1"), now) {
+		t.Fatal("New source allowed while all sources are active.")
+	}
+	if !s.Allow(net.ParseIP("192.168.0.1"), now.Add(time.Second)) || len(s.buckets) != 1 {
+		t.Fatal("Idle sources not forgotten.", len(s.buckets))
+	}
+}
+
+func TestAccessList(t *testing.T) {
+	allow, err := ParseNetworks([]string{"10.0.0.0/8", "2001:db8::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, _ := ParseNetworks([]string{"10.1.0.0/16"})
+	s := AccessList{allow, deny}
+	for ip, want := range map[string]bool{
+		"10.2.3.4":    true,
+		"10.1.3.4":    false,
+		"192.168.1.1": false,
+		"2001:db8::1": true,
+		"2001:db8::2": false,
+	} {
+		if s.Permit(net.ParseIP(ip)) != want {
+			t.Fatal("Error permit.", ip)
+		}
+	}
+	if (&AccessList{}).Permit(net.ParseIP("192.168.1.1")) != true {
+		t.Fatal("Empty list denies.")
+	}
+	if _, err := ParseNetworks([]string{"10.0.0"}); err == nil {
+		t.Fatal("Wrong address accepted.")
+	}
+}
+
+func TestEchoUnknownPeer(t *testing.T) {
+	center, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("Can't listen udp.", err)
+	}
+	defer center.Close()
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("Can't listen udp.", err)
+	}
+	defer client.Close()
+
+	// Legacy packages are never authenticated.
+	data := (&EchoPackage{Id: 1}).ToData(NewHeader(PackageTypeEchoRequest, 0, 0))
+	header, payload, _ := LoadHeader(data)
+	before := Drops().UnknownPeer
+	message, _ := DecodeEcho(header, payload)
+	EchoRequestHandler(&Request{center, client.LocalAddr().(*net.UDPAddr), header, payload, message})
+	if Drops().UnknownPeer != before+1 {
+		t.Fatal("Unknown peer not dropped.")
+	}
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := client.ReadFromUDP(make([]byte, 1024)); err == nil {
+		t.Fatal("Replied to unknown peer.")
+	}
+
+	// Neither are authenticated ones, and replays of those of known peers.
+	data = (&EchoPackage{Id: 2}).ToData(NewHeader(PackageTypeEchoRequest, ProtocolVersion, 0))
+	echo := func() error {
+		header, payload, _ := LoadHeader(data)
+		message, _ := DecodeEcho(header, payload)
+		EchoRequestHandler(&Request{center, client.LocalAddr().(*net.UDPAddr), header, payload, message})
+		client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		_, _, err := client.ReadFromUDP(make([]byte, 1024))
+		return err
+	}
+	if echo() == nil {
+		t.Fatal("Replied to unknown authenticated peer.")
+	}
+	address := client.LocalAddr().(*net.UDPAddr)
+	service = &MainService{Servers: map[string]*RemoteServer{"client": (&RemoteServer{}).Init(address.IP, uint16(address.Port))},
+		maxAge: time.Minute}
+	defer func() { service = nil }()
+	if err := echo(); err != nil {
+		t.Fatal("Known peer not answered.", err)
+	}
+	if echo() == nil {
+		t.Fatal("Replied to replayed request.")
+	}
+}
+
+func TestFilterBeforeQueue(t *testing.T) {
+	deny, _ := ParseNetworks([]string{"10.0.1.0/24"})
+	s := &UdpService{limiter: (&RateLimiter{}).Init(1, 2), access: AccessList{Deny: deny}}
+	s.pipeline = (&Pipeline{}).Init(1, 16, func(p *Package) {})
+	s.pipeline.Filter = s.filter
+	push := func(ip string) bool {
+		return s.pipeline.push(&Package{Data: []byte{0}, Address: &net.UDPAddr{IP: net.ParseIP(ip), Port: 1000}})
+	}
+	denied, limited := Drops().Denied, Drops().RateLimited
+	if !push("10.0.0.1") || !push("10.0.0.1") || push("10.0.0.1") || push("10.0.1.1") {
+		t.Fatal("Error filtered packages.")
+	}
+	if Drops().RateLimited != limited+1 || Drops().Denied != denied+1 || s.pipeline.Stats().Queued != 2 {
+		t.Fatal("Error filter drops.", Drops(), s.pipeline.Stats())
+	}
+}
@@ -0,0 +1,183 @@
+package udp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request is a received package. Message is nil until the codec of the
+// package type decoded Payload, so middleware only sees the header.
+type Request struct {
+	Connection PacketWriter
+	Address    *net.UDPAddr
+	Header     *Header
+	Payload    []byte
+	Message    interface{}
+}
+
+// Codec decodes the payload of a package type into its message.
+type Codec func(header *Header, payload []byte) (interface{}, error)
+
+// MessageHandler handles a request.
+type MessageHandler func(*Request)
+
+// Middleware wraps a MessageHandler, e.g. to check or count requests
+// before they are decoded and handled.
+type Middleware func(MessageHandler) MessageHandler
+
+// Chain wraps handler in middleware, the first one outermost.
+func Chain(handler MessageHandler, middleware ...Middleware) MessageHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+type route struct {
+	codec   Codec
+	handler MessageHandler
+	chain   MessageHandler
+}
+
+// Router dispatches requests by package type to the registered codec and
+// handler, through the middleware.
+type Router struct {
+	routes     map[byte]*route
+	middleware []Middleware
+	mutex      sync.RWMutex
+}
+
+func (s *Router) Init() *Router {
+	s.routes = make(map[byte]*route)
+	return s
+}
+
+// Register sets the codec and handler of packageType. The handler receives
+// the decoded message, packages which don't decode are dropped.
+func (s *Router) Register(packageType byte, codec Codec, handler MessageHandler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	r := &route{codec: codec, handler: handler}
+	r.chain = Chain(r.decode, s.middleware...)
+	s.routes[packageType] = r
+}
+
+func (s *Router) Unregister(packageType byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.routes, packageType)
+}
+
+// Use appends middleware for all package types.
+func (s *Router) Use(middleware ...Middleware) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.middleware = append(s.middleware, middleware...)
+	for _, r := range s.routes {
+		r.chain = Chain(r.decode, s.middleware...)
+	}
+}
+
+// Dispatch handles r, it returns false for unregistered package types.
+func (s *Router) Dispatch(r *Request) bool {
+	s.mutex.RLock()
+	route, ok := s.routes[r.Header.Type]
+	s.mutex.RUnlock()
+	if !ok {
+		return false
+	}
+	route.chain(r)
+	return true
+}
+
+func (s *route) decode(r *Request) {
+	message, err := s.codec(r.Header, r.Payload)
+	if err != nil {
+		log.Info("Receive wrong package type %d from %s. %s", r.Header.Type, r.Address.String(), err.Error())
+		countDrop(&drops.Malformed)
+		return
+	}
+	r.Message = message
+	s.handler(r)
+}
+
+// Authenticate drops unauthenticated requests when requireAuth is set, and
+// requests without identity when requireIdentity is set. Registrations and
+// their answers pass, their handlers tell why they failed.
+func Authenticate(requireAuth bool, requireIdentity bool) Middleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(r *Request) {
+			if r.Header.Type == PackageTypeRegister || r.Header.Type == PackageTypeRegisterAck {
+				next(r)
+				return
+			}
+			if requireAuth && !r.Header.Authenticated {
+				log.Info("Receive unauthenticated package from %s.", r.Address.String())
+				countDrop(&drops.Unauthenticated)
+				return
+			}
+			if requireIdentity && r.Header.Identity == 0 {
+				log.Info("Receive package without identity from %s.", r.Address.String())
+				countDrop(&drops.Unauthenticated)
+				return
+			}
+			next(r)
+		}
+	}
+}
+
+// Trace logs each request and how long handling it took.
+func Trace(next MessageHandler) MessageHandler {
+	return func(r *Request) {
+		start := time.Now()
+		next(r)
+		log.Debug("Handle package type %d version %d from %s in %s.",
+			r.Header.Type, r.Header.Version, r.Address.String(), time.Since(start).String())
+	}
+}
+
+// TypeMetrics counts the requests of a package type. Handled requests were
+// decoded and passed to the handler, Time is the total handling time.
+type TypeMetrics struct {
+	Received uint64
+	Handled  uint64
+	Time     time.Duration
+}
+
+// Metrics counts requests by package type.
+type Metrics struct {
+	types [256]TypeMetrics
+}
+
+func (s *Metrics) Middleware(next MessageHandler) MessageHandler {
+	return func(r *Request) {
+		m := &s.types[r.Header.Type]
+		atomic.AddUint64(&m.Received, 1)
+		start := time.Now()
+		next(r)
+		if r.Message != nil {
+			atomic.AddUint64(&m.Handled, 1)
+		}
+		atomic.AddInt64((*int64)(&m.Time), int64(time.Since(start)))
+	}
+}
+
+// Types returns the counters of the package types seen.
+func (s *Metrics) Types() map[byte]TypeMetrics {
+	result := make(map[byte]TypeMetrics)
+	for i := range s.types {
+		m := &s.types[i]
+		received := atomic.LoadUint64(&m.Received)
+		if received == 0 {
+			continue
+		}
+		result[byte(i)] = TypeMetrics{
+			Received: received,
+			Handled:  atomic.LoadUint64(&m.Handled),
+			Time:     time.Duration(atomic.LoadInt64((*int64)(&m.Time))),
+		}
+	}
+	return result
+}
@@ -0,0 +1,66 @@
+package udp
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	var order []string
+	tag := func(name string) Middleware {
+		return func(next MessageHandler) MessageHandler {
+			return func(r *Request) {
+				if r.Message != nil {
+					t.Fatal("Middleware sees decoded message.")
+				}
+				order = append(order, name)
+				next(r)
+			}
+		}
+	}
+	metrics := Metrics{}
+	s := (&Router{}).Init()
+	s.Use(metrics.Middleware, tag("a"))
+	var handled []interface{}
+	s.Register(7, func(header *Header, payload []byte) (interface{}, error) {
+		if len(payload) == 0 {
+			return nil, errors.New("Empty.")
+		}
+		return string(payload), nil
+	}, func(r *Request) {
+		handled = append(handled, r.Message)
+	})
+	s.Use(tag("b"))
+
+	address := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	if !s.Dispatch(&Request{nil, address, &Header{Type: 7}, []byte("x"), nil}) || len(handled) != 1 || handled[0] != "x" {
+		t.Fatal("Error dispatch.", handled)
+	}
+	if len(order) != 2 || order[0] != "a" || order[1] != "b" {
+		t.Fatal("Error middleware order.", order)
+	}
+	malformed := Drops().Malformed
+	s.Dispatch(&Request{nil, address, &Header{Type: 7}, nil, nil})
+	if len(handled) != 1 || Drops().Malformed != malformed+1 {
+		t.Fatal("Malformed package handled.")
+	}
+	if s.Dispatch(&Request{nil, address, &Header{Type: 8}, nil, nil}) {
+		t.Fatal("Unknown type dispatched.")
+	}
+	if m := metrics.Types()[7]; m.Received != 2 || m.Handled != 1 {
+		t.Fatal("Error metrics.", m)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	called := 0
+	handler := Chain(func(*Request) { called++ }, Authenticate(true, true))
+	address := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	handler(&Request{Address: address, Header: &Header{}})
+	handler(&Request{Address: address, Header: &Header{Authenticated: true}})
+	handler(&Request{Address: address, Header: &Header{Authenticated: true, Identity: 3}})
+	if called != 1 {
+		t.Fatal("Error authenticate.", called)
+	}
+}
@@ -0,0 +1,174 @@
+package udp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const NodeIdLength = 16
+
+// NodeId identifies a node across address changes. It is generated on the
+// first run and kept in a file.
+type NodeId [NodeIdLength]byte
+
+func (s NodeId) IsZero() bool {
+	return s == NodeId{}
+}
+
+func (s NodeId) String() string {
+	return hex.EncodeToString(s[:])
+}
+
+func (s NodeId) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func ParseNodeId(str string) (NodeId, error) {
+	id := NodeId{}
+	data, err := hex.DecodeString(strings.TrimSpace(str))
+	if err != nil {
+		return id, err
+	}
+	if len(data) != NodeIdLength {
+		return id, errors.New("Wrong node id length.")
+	}
+	copy(id[:], data)
+	return id, nil
+}
+
+// LoadNodeId reads the node id from path, creating it on the first run.
+func LoadNodeId(path string) (NodeId, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		return ParseNodeId(string(data))
+	}
+	if !os.IsNotExist(err) {
+		return NodeId{}, err
+	}
+	id := NodeId{}
+	if _, err := rand.Read(id[:]); err != nil {
+		return id, err
+	}
+	log.Warning("Generate node id %s.", id.String())
+	return id, ioutil.WriteFile(path, []byte(id.String()+"\n"), 0644)
+}
+
+// nodeKey is the key of a server in MainService.Servers: its node id, or its
+// address for nodes which do not announce one.
+func nodeKey(id NodeId, ip net.IP, port uint16) string {
+	if !id.IsZero() {
+		return id.String()
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// NodeInfo describes the sender of a sync package.
+type NodeInfo struct {
+	Id     NodeId
+	Name   string
+	Labels map[string]string
+}
+
+func putString(data []byte, str string) int {
+	data[0] = byte(len(str))
+	copy(data[1:], str)
+	return 1 + len(str)
+}
+
+func readString(data []byte) (string, int, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", 0, errors.New("String truncated.")
+	}
+	return string(data[1 : 1+int(data[0])]), 1 + int(data[0]), nil
+}
+
+func (s *NodeInfo) labelKeys() []string {
+	keys := make([]string, 0, len(s.Labels))
+	for k := range s.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Validate checks the node info fits the encoding: strings and the label
+// count are limited to 255.
+func (s *NodeInfo) Validate() error {
+	if len(s.Name) > 255 || len(s.Labels) > 255 {
+		return errors.New("Node name or labels too long.")
+	}
+	for k, v := range s.Labels {
+		if len(k) > 255 || len(v) > 255 {
+			return errors.New("Node label too long.")
+		}
+	}
+	if s.length() > SyncPackageSize/4 {
+		return errors.New("Node name and labels too long.")
+	}
+	return nil
+}
+
+func (s *NodeInfo) length() int {
+	length := NodeIdLength + 1 + len(s.Name) + 1
+	for k, v := range s.Labels {
+		length += 2 + len(k) + len(v)
+	}
+	return length
+}
+
+func (s *NodeInfo) toData(data []byte) int {
+	copy(data[0:NodeIdLength], s.Id[:])
+	start := NodeIdLength
+	start += putString(data[start:], s.Name)
+	data[start] = byte(len(s.Labels))
+	start++
+	for _, k := range s.labelKeys() {
+		start += putString(data[start:], k)
+		start += putString(data[start:], s.Labels[k])
+	}
+	return start
+}
+
+func (s *NodeInfo) loadFromData(data []byte) (int, error) {
+	if len(data) < NodeIdLength {
+		return 0, errors.New("Node info truncated.")
+	}
+	copy(s.Id[:], data[0:NodeIdLength])
+	start := NodeIdLength
+	name, length, err := readString(data[start:])
+	if err != nil {
+		return 0, err
+	}
+	s.Name = name
+	start += length
+	if len(data) < start+1 {
+		return 0, errors.New("Node info truncated.")
+	}
+	count := int(data[start])
+	start++
+	s.Labels = make(map[string]string, count)
+	for i := 0; i < count; i++ {
+		k, length, err := readString(data[start:])
+		if err != nil {
+			return 0, err
+		}
+		start += length
+		v, length, err := readString(data[start:])
+		if err != nil {
+			return 0, err
+		}
+		start += length
+		if _, ok := s.Labels[k]; ok {
+			return 0, errors.New("Duplicate node label.")
+		}
+		s.Labels[k] = v
+	}
+	return start, nil
+}
@@ -0,0 +1,21 @@
+package udp
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadNodeId(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node_id")
+	id, err := LoadNodeId(path)
+	if err != nil || id.IsZero() {
+		t.Fatal("Generate node id failed.", err)
+	}
+	again, err := LoadNodeId(path)
+	if err != nil || again != id {
+		t.Fatal("Node id not persisted.", id, again, err)
+	}
+	if nodeKey(id, nil, 0) != id.String() || nodeKey(NodeId{}, []byte{10, 0, 0, 1}, 80) != "10.0.0.1:80" {
+		t.Fatal("Error node key.")
+	}
+}
@@ -0,0 +1,77 @@
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Ids of the parameters in sync packages. Servers skip ids they don't know,
+// so newer centers can distribute more settings.
+const (
+	ParameterPingEvery   = 1
+	ParameterSyncEvery   = 2
+	ParameterOfflineTime = 3
+)
+
+// MinInterval bounds the intervals a center may set, in milliseconds.
+const MinInterval = 10
+
+// Parameters are the intervals in milliseconds a server uses, zero is unset.
+// The center sends its own to the clients, the clients report back the ones
+// they use.
+type Parameters struct {
+	PingEvery   uint32
+	SyncEvery   uint32
+	OfflineTime uint32
+}
+
+func (s *Parameters) values() [][2]uint32 {
+	var result [][2]uint32
+	for _, v := range [][2]uint32{
+		{ParameterPingEvery, s.PingEvery},
+		{ParameterSyncEvery, s.SyncEvery},
+		{ParameterOfflineTime, s.OfflineTime},
+	} {
+		if v[1] != 0 {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// length is one count byte and an id byte and value per set parameter.
+func (s *Parameters) length() int {
+	return 1 + 5*len(s.values())
+}
+
+func (s *Parameters) toData(data []byte) int {
+	values := s.values()
+	data[0] = byte(len(values))
+	start := 1
+	for _, v := range values {
+		data[start] = byte(v[0])
+		binary.BigEndian.PutUint32(data[start+1:start+5], v[1])
+		start += 5
+	}
+	return start
+}
+
+func (s *Parameters) loadFromData(data []byte) (int, error) {
+	if len(data) < 1 || len(data) < 1+5*int(data[0]) {
+		return 0, errors.New("Parameters truncated.")
+	}
+	start := 1
+	for i := 0; i < int(data[0]); i++ {
+		value := binary.BigEndian.Uint32(data[start+1 : start+5])
+		switch data[start] {
+		case ParameterPingEvery:
+			s.PingEvery = value
+		case ParameterSyncEvery:
+			s.SyncEvery = value
+		case ParameterOfflineTime:
+			s.OfflineTime = value
+		}
+		start += 5
+	}
+	return start, nil
+}
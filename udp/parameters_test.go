@@ -0,0 +1,43 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParametersParser(t *testing.T) {
+	p := (&SyncPackage{}).Init()
+	p.Self = ServerInfo{Ip: net.ParseIP("10.0.0.1"), Port: 1000}
+	p.Parameters = Parameters{PingEvery: 500, OfflineTime: 5000}
+	d, _ := p.ToData(NewHeader(PackageTypeSync, ProtocolVersion, 0))
+	header, payload, err := LoadHeader(d[0])
+	if err != nil {
+		t.Fatal("Load header failed.", err)
+	}
+	r := (&SyncPackage{}).Init()
+	if err := r.LoadFromData(header, payload); err != nil || r.Parameters != p.Parameters {
+		t.Fatal("Parameters differ.", r.Parameters, err)
+	}
+
+	// Unknown parameters are skipped.
+	data := []byte{2, 9, 0, 0, 0, 1, ParameterSyncEvery, 0, 0, 7, 208}
+	parameters := Parameters{}
+	if n, err := parameters.loadFromData(data); err != nil || n != len(data) || parameters != (Parameters{SyncEvery: 2000}) {
+		t.Fatal("Error parameters.", parameters, n, err)
+	}
+	if _, err := parameters.loadFromData(data[:8]); err == nil {
+		t.Fatal("Truncated parameters loaded.")
+	}
+}
+
+func TestApplyParameters(t *testing.T) {
+	s := &MainService{pingEvery: time.Second, syncEvery: 10 * time.Second, offlineTime: time.Minute}
+	s.apply(Parameters{PingEvery: 200, SyncEvery: 1, OfflineTime: 0})
+	if s.pingEvery != 200*time.Millisecond || s.syncEvery != 10*time.Second || s.offlineTime != time.Minute {
+		t.Fatal("Error applied parameters.", s.parameters())
+	}
+	if p := s.parameters(); p != (Parameters{200, 10000, 60000}) {
+		t.Fatal("Error reported parameters.", p)
+	}
+}
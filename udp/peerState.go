@@ -0,0 +1,82 @@
+package udp
+
+// peerEntry is the last announced state of one server and the state version
+// at which it last changed.
+type peerEntry struct {
+	info    ServerInfo
+	version uint64
+	removed bool
+}
+
+// PeerState versions the list of servers the center announces, so each
+// client only gets what was added, changed or removed since the version it
+// acknowledged.
+type PeerState struct {
+	Version uint64
+	entries map[string]*peerEntry
+	pruned  uint64
+}
+
+func (s *PeerState) Init() *PeerState {
+	s.entries = make(map[string]*peerEntry)
+	return s
+}
+
+// samePeer ignores the probe results, which change on every sync.
+func samePeer(a *ServerInfo, b *ServerInfo) bool {
+	return a.Ip.Equal(b.Ip) && a.Port == b.Port && a.Version == b.Version &&
+		a.Capabilities == b.Capabilities && a.NodeId == b.NodeId
+}
+
+// Update records the servers currently announced, keyed by node key.
+func (s *PeerState) Update(current map[string]*ServerInfo) {
+	for k, v := range current {
+		entry, ok := s.entries[k]
+		if ok && !entry.removed && samePeer(&entry.info, v) {
+			entry.info = *v
+			continue
+		}
+		s.Version++
+		s.entries[k] = &peerEntry{*v, s.Version, false}
+	}
+	for k, v := range s.entries {
+		if _, ok := current[k]; !ok && !v.removed {
+			s.Version++
+			v.version = s.Version
+			v.removed = true
+		}
+	}
+}
+
+// CanDelta reports whether a delta since version can be built, which is not
+// the case once removals after it were pruned.
+func (s *PeerState) CanDelta(since uint64) bool {
+	return since > 0 && since >= s.pruned && since <= s.Version
+}
+
+// Delta returns the servers changed after since. Removed servers are
+// returned with Removed set.
+func (s *PeerState) Delta(since uint64) []*ServerInfo {
+	result := make([]*ServerInfo, 0)
+	for _, v := range s.entries {
+		if v.version <= since {
+			continue
+		}
+		info := v.info
+		info.Removed = v.removed
+		result = append(result, &info)
+	}
+	return result
+}
+
+// Prune forgets removals every client acknowledged.
+func (s *PeerState) Prune(before uint64) {
+	for k, v := range s.entries {
+		if v.removed && v.version <= before {
+			delete(s.entries, k)
+			if v.version > s.pruned {
+				s.pruned = v.version
+			}
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPeerState(t *testing.T) {
+	s := (&PeerState{}).Init()
+	a := &ServerInfo{Ip: net.ParseIP("10.0.0.1"), Port: 1, NodeId: NodeId{1}}
+	b := &ServerInfo{Ip: net.ParseIP("10.0.0.2"), Port: 2, NodeId: NodeId{2}}
+	s.Update(map[string]*ServerInfo{"a": a, "b": b})
+	v1 := s.Version
+	if v1 != 2 || len(s.Delta(0)) != 2 {
+		t.Fatal("Error initial state.", v1)
+	}
+
+	// Probe results alone do not make a change.
+	a2 := *a
+	a2.Latency = 100
+	s.Update(map[string]*ServerInfo{"a": &a2, "b": b})
+	if s.Version != v1 || len(s.Delta(v1)) != 0 {
+		t.Fatal("Probe result changed state.", s.Version)
+	}
+
+	b2 := *b
+	b2.Ip = net.ParseIP("10.0.0.3")
+	s.Update(map[string]*ServerInfo{"b": &b2})
+	delta := s.Delta(v1)
+	if len(delta) != 2 {
+		t.Fatal("Error delta size.", len(delta))
+	}
+	for _, v := range delta {
+		if v.NodeId == a.NodeId && !v.Removed {
+			t.Fatal("Removal not in delta.")
+		}
+		if v.NodeId == b.NodeId && (v.Removed || !v.Ip.Equal(b2.Ip)) {
+			t.Fatal("Change not in delta.", v)
+		}
+	}
+
+	if !s.CanDelta(v1) {
+		t.Fatal("Can't delta before prune.")
+	}
+	s.Prune(s.Version)
+	if s.CanDelta(v1) || !s.CanDelta(s.Version) || s.CanDelta(0) || s.CanDelta(s.Version+1) {
+		t.Fatal("Error CanDelta after prune.")
+	}
+	if len(s.Delta(0)) != 1 {
+		t.Fatal("Removal not pruned.")
+	}
+}
+
+func TestFullSyncKeepsGossip(t *testing.T) {
+	udpService = &UdpService{isServer: false}
+	defer func() { udpService = nil }()
+	s := &MainService{Servers: make(map[string]*RemoteServer), maxAge: time.Minute}
+	s.reassembler = (&Reassembler{}).Init(time.Second)
+	s.election = (&Election{}).Init(NodeId{9}, time.Minute, false, 1, time.Now())
+	address := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	center := (&RemoteServer{}).Init(address.IP, uint16(address.Port))
+	center.NodeId = NodeId{1}
+	center.Center = true
+	s.Servers[center.key()] = center
+	s.election.Observe(&LeasePackage{1, NodeId{1}, 60000}, time.Now())
+	sync := func(version uint64, servers ...*ServerInfo) {
+		p := (&SyncPackage{}).Init()
+		p.Self = ServerInfo{Ip: net.ParseIP("10.0.0.9"), Port: 9000}
+		p.Node = NodeInfo{NodeId{1}, "center", nil}
+		p.StateVersion = version
+		for _, v := range servers {
+			p.Servers.Push(v)
+		}
+		d, _ := p.ToData(NewHeader(PackageTypeSync, ProtocolVersion, 0))
+		header, payload, _ := LoadHeader(d[0])
+		message, err := DecodeSync(header, payload)
+		if err != nil {
+			t.Fatal("Decode sync failed.", err)
+		}
+		s.syncHandler(&Request{nil, address, header, payload, message})
+	}
+	announced := &ServerInfo{Ip: net.ParseIP("10.0.0.2"), Port: 2000, NodeId: NodeId{2}, Version: ProtocolVersion}
+	sync(1, announced)
+	seed := (&RemoteServer{}).Init(net.ParseIP("10.0.0.3"), 3000)
+	seed.Seed = true
+	s.Servers[seed.key()] = seed
+	gossiped := (&RemoteServer{}).Init(net.ParseIP("10.0.0.4"), 4000)
+	gossiped.NodeId = NodeId{4}
+	s.Servers[gossiped.key()] = gossiped
+
+	if _, ok := s.Servers[(&RemoteServer{NodeId: NodeId{2}}).key()]; !ok {
+		t.Fatal("Announced server not added.")
+	}
+	sync(2)
+	if _, ok := s.Servers[(&RemoteServer{NodeId: NodeId{2}}).key()]; ok {
+		t.Fatal("Server the center no longer lists kept.")
+	}
+	if len(s.Servers) != 3 || s.Servers[seed.key()] == nil || s.Servers[gossiped.key()] == nil {
+		t.Fatal("Full sync removed seeds or gossiped servers.", len(s.Servers))
+	}
+}
+
+func TestPeerStateSkipsTargets(t *testing.T) {
+	s := &MainService{Servers: make(map[string]*RemoteServer), peerState: (&PeerState{}).Init()}
+	peer := (&RemoteServer{}).Init(net.ParseIP("10.0.0.1"), 1000)
+	peer.NodeId = NodeId{1}
+	s.Servers[peer.key()] = peer
+	target := (&RemoteServer{}).Init(net.ParseIP("10.0.0.2"), 53)
+	target.Target = "dns"
+	s.Servers["target:dns"] = target
+	s.updatePeerState()
+	delta := s.peerState.Delta(0)
+	if len(delta) != 1 || delta[0].NodeId != peer.NodeId {
+		t.Fatal("Target announced as peer.", delta)
+	}
+}
@@ -0,0 +1,125 @@
+package udp
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ReceiveBufferSize is the size of the buffers packages are read into.
+const ReceiveBufferSize = SyncPackageSize
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, ReceiveBufferSize)
+		return &b
+	},
+}
+
+// Package is a received package waiting in the pipeline. Data is only valid
+// until the handler returns, then its buffer goes back to the pool.
+type Package struct {
+	Data    []byte
+	Address *net.UDPAddr
+	buffer  *[]byte
+}
+
+func (s *Package) release() {
+	if s.buffer != nil {
+		bufferPool.Put(s.buffer)
+		s.buffer = nil
+	}
+}
+
+// PipelineStats counts the packages through the pipeline. Dropped packages
+// arrived while all workers were busy and the queue was full.
+type PipelineStats struct {
+	Received    uint64
+	Processed   uint64
+	Dropped     uint64
+	Queued      int
+	QueueLength int
+	Workers     int
+}
+
+// Pipeline reads packages into pooled buffers and handles them on a bounded
+// number of workers, so a slow handler doesn't stall receiving.
+type Pipeline struct {
+	Filter    func(*Package) bool
+	queue     chan *Package
+	workers   int
+	handle    func(*Package)
+	received  uint64
+	processed uint64
+	dropped   uint64
+	wait      sync.WaitGroup
+}
+
+func (s *Pipeline) Init(workers int, length int, handle func(*Package)) *Pipeline {
+	s.queue = make(chan *Package, length)
+	s.workers = workers
+	s.handle = handle
+	return s
+}
+
+func (s *Pipeline) Start() {
+	for i := 0; i < s.workers; i++ {
+		s.wait.Add(1)
+		go s.work()
+	}
+}
+
+// Stop lets the workers finish the queued packages and waits for them.
+func (s *Pipeline) Stop() {
+	close(s.queue)
+	s.wait.Wait()
+}
+
+func (s *Pipeline) work() {
+	defer s.wait.Done()
+	for p := range s.queue {
+		s.handle(p)
+		p.release()
+		atomic.AddUint64(&s.processed, 1)
+	}
+}
+
+// Read receives one package from connection and queues it.
+func (s *Pipeline) Read(connection *net.UDPConn) error {
+	buffer := bufferPool.Get().(*[]byte)
+	n, address, err := connection.ReadFromUDP(*buffer)
+	if err != nil || n <= 0 {
+		bufferPool.Put(buffer)
+		return err
+	}
+	s.push(&Package{(*buffer)[:n], address, buffer})
+	return nil
+}
+
+// push queues p, or drops it when Filter rejects it or the queue is full.
+func (s *Pipeline) push(p *Package) bool {
+	if s.Filter != nil && !s.Filter(p) {
+		p.release()
+		return false
+	}
+	atomic.AddUint64(&s.received, 1)
+	select {
+	case s.queue <- p:
+		return true
+	default:
+		atomic.AddUint64(&s.dropped, 1)
+		p.release()
+		return false
+	}
+}
+
+func (s *Pipeline) Stats() PipelineStats {
+	return PipelineStats{
+		Received:    atomic.LoadUint64(&s.received),
+		Processed:   atomic.LoadUint64(&s.processed),
+		Dropped:     atomic.LoadUint64(&s.dropped),
+		Queued:      len(s.queue),
+		QueueLength: cap(s.queue),
+		Workers:     s.workers,
+	}
+}
@@ -0,0 +1,74 @@
+package udp
+
+import (
+	"net"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPipelineBackpressure(t *testing.T) {
+	block := make(chan struct{})
+	p := (&Pipeline{}).Init(1, 1, func(*Package) { <-block })
+	p.Start()
+	p.push(&Package{})
+	// Wait for the worker to take the first package, then fill the queue.
+	for p.Stats().Queued != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if !p.push(&Package{}) || p.push(&Package{}) {
+		t.Fatal("Error queue length.")
+	}
+	close(block)
+	p.Stop()
+	stats := p.Stats()
+	if stats.Received != 3 || stats.Processed != 2 || stats.Dropped != 1 {
+		t.Fatal("Error stats.", stats)
+	}
+}
+
+func BenchmarkPipeline(b *testing.B) {
+	listener, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	var handled uint64
+	s := &UdpService{router: (&Router{}).Init(), connection: listener}
+	s.Register(PackageTypeEchoRequest, DecodeEcho, func(*Request) {
+		atomic.AddUint64(&handled, 1)
+	})
+	s.pipeline = (&Pipeline{}).Init(4, 1024, s.handlePackage)
+	s.pipeline.Start()
+	go func() {
+		for s.pipeline.Read(listener) == nil {
+		}
+	}()
+	sender, err := net.DialUDP("udp", nil, listener.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer sender.Close()
+	data := (&EchoPackage{Id: 1}).ToData(NewHeader(PackageTypeEchoRequest, ProtocolVersion, LocalCapabilities))
+
+	b.ResetTimer()
+	start := time.Now()
+	// Keep at most a socket buffer of packages in flight, so the kernel
+	// doesn't drop them and the rate is what the pipeline sustains.
+	for i := 0; i < b.N; i++ {
+		for uint64(i)-atomic.LoadUint64(&handled)-s.pipeline.Stats().Dropped > 128 {
+			runtime.Gosched()
+		}
+		sender.Write(data)
+	}
+	for atomic.LoadUint64(&handled)+s.pipeline.Stats().Dropped < uint64(b.N) {
+		if time.Since(start) > 10*time.Second {
+			b.Fatal("Packages lost.", s.pipeline.Stats())
+		}
+		runtime.Gosched()
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "packages/s")
+	b.ReportMetric(float64(s.pipeline.Stats().Dropped), "dropped")
+}
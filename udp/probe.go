@@ -0,0 +1,195 @@
+package udp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+	"github.com/Catofes/go-its/config"
+)
+
+// MaxProbeBody is how much of a http response is searched for the body.
+const MaxProbeBody = 64 * 1024
+
+// Prober checks a target once. The round trip is measured by the caller.
+type Prober interface {
+	Probe(timeout time.Duration) error
+}
+
+// NewProber returns the prober of target. Udp targets are peers probed with
+// the echo package, for them it returns nil.
+func NewProber(target config.ProbeTarget) (Prober, error) {
+	switch target.Type {
+	case "udp":
+		return nil, nil
+	case "tcp":
+		return &TcpProbe{target.Address}, nil
+	case "http":
+		return &HttpProbe{target.Url, target.Status, target.Body}, nil
+	case "dns":
+		return &DnsProbe{target.Address, target.Query}, nil
+	case "icmp":
+		return NewIcmpProbe(target.Address)
+	}
+	return nil, errors.New("Unknown probe type.")
+}
+
+// TcpProbe succeeds when a tcp connection to Address is established.
+type TcpProbe struct {
+	Address string
+}
+
+func (s *TcpProbe) Probe(timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", s.Address, timeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// HttpProbe succeeds when a GET of Url answers Status and contains Body.
+type HttpProbe struct {
+	Url    string
+	Status int
+	Body   string
+}
+
+func (s *HttpProbe) Probe(timeout time.Duration) error {
+	client := http.Client{Timeout: timeout}
+	response, err := client.Get(s.Url)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != s.Status {
+		return errors.New("Wrong response status.")
+	}
+	if s.Body == "" {
+		return nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, MaxProbeBody))
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(string(body), s.Body) {
+		return errors.New("Body not found in response.")
+	}
+	return nil
+}
+
+// DnsProbe succeeds when Query resolves on Server, or on the system
+// resolver when Server is empty.
+type DnsProbe struct {
+	Server string
+	Query  string
+}
+
+func (s *DnsProbe) Probe(timeout time.Duration) error {
+	resolver := net.DefaultResolver
+	if s.Server != "" {
+		resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{}
+				return d.DialContext(ctx, network, s.Server)
+			},
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	addresses, err := resolver.LookupHost(ctx, s.Query)
+	if err != nil {
+		return err
+	}
+	if len(addresses) == 0 {
+		return errors.New("No address.")
+	}
+	return nil
+}
+
+// IcmpProbe sends raw icmp echo requests, which needs privileges.
+type IcmpProbe struct {
+	Address  *net.IPAddr
+	network  string
+	id       uint16
+	sequence uint32
+}
+
+// NewIcmpProbe resolves address and checks a raw socket can be opened.
+func NewIcmpProbe(address string) (*IcmpProbe, error) {
+	ip, err := net.ResolveIPAddr("ip", address)
+	if err != nil {
+		return nil, err
+	}
+	s := &IcmpProbe{Address: ip, network: "ip4:icmp", id: uint16(os.Getpid())}
+	if ip.IP.To4() == nil {
+		s.network = "ip6:ipv6-icmp"
+	}
+	conn, err := net.ListenPacket(s.network, "")
+	if err != nil {
+		log.Warning("Can't open raw icmp socket. %s", err.Error())
+		return nil, errors.New("Raw icmp not permitted.")
+	}
+	conn.Close()
+	return s, nil
+}
+
+func (s *IcmpProbe) Probe(timeout time.Duration) error {
+	conn, err := net.ListenPacket(s.network, "")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	sequence := uint16(atomic.AddUint32(&s.sequence, 1))
+	request, reply := byte(8), byte(0)
+	if s.network != "ip4:icmp" {
+		request, reply = 128, 129
+	}
+	data := make([]byte, 16)
+	data[0] = request
+	binary.BigEndian.PutUint16(data[4:], s.id)
+	binary.BigEndian.PutUint16(data[6:], sequence)
+	binary.BigEndian.PutUint64(data[8:], uint64(time.Now().UnixNano()))
+	if request == 8 {
+		// The kernel fills in the checksum of icmpv6.
+		binary.BigEndian.PutUint16(data[2:], icmpChecksum(data))
+	}
+	if _, err := conn.WriteTo(data, s.Address); err != nil {
+		return err
+	}
+	buffer := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+		if n < 8 || buffer[0] != reply || !addr.(*net.IPAddr).IP.Equal(s.Address.IP) {
+			continue
+		}
+		if binary.BigEndian.Uint16(buffer[4:]) == s.id && binary.BigEndian.Uint16(buffer[6:]) == sequence {
+			return nil
+		}
+	}
+}
+
+func icmpChecksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
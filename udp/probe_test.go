@@ -0,0 +1,65 @@
+package udp
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+	"github.com/Catofes/go-its/config"
+)
+
+func TestTcpProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	prober, _ := NewProber(config.ProbeTarget{Type: "tcp", Address: address})
+	if err := prober.Probe(time.Second); err != nil {
+		t.Fatal("Tcp probe failed.", err)
+	}
+	listener.Close()
+	if err := prober.Probe(time.Second); err == nil {
+		t.Fatal("Tcp probe to closed port succeeded.")
+	}
+}
+
+func TestHttpProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("status: ok"))
+	}))
+	defer server.Close()
+	if err := (&HttpProbe{server.URL, 200, "ok"}).Probe(time.Second); err != nil {
+		t.Fatal("Http probe failed.", err)
+	}
+	if err := (&HttpProbe{server.URL, 200, "down"}).Probe(time.Second); err == nil {
+		t.Fatal("Http probe ignored body.")
+	}
+	if err := (&HttpProbe{server.URL + "/missing", 200, ""}).Probe(time.Second); err == nil {
+		t.Fatal("Http probe ignored status.")
+	}
+}
+
+func TestNewProber(t *testing.T) {
+	if p, err := NewProber(config.ProbeTarget{Type: "udp"}); p != nil || err != nil {
+		t.Fatal("Udp target should use echo packages.")
+	}
+	if _, err := NewProber(config.ProbeTarget{Type: "smtp"}); err == nil {
+		t.Fatal("Unknown probe type accepted.")
+	}
+}
+
+func TestICMPStackRecord(t *testing.T) {
+	s := (&ICMPStack{}).Init(4)
+	s.Get()
+	echo := s.Get()
+	s.Record(echo, 10*time.Millisecond)
+	if s.ReceivedPackageCount != 1 || s.Latency != int64(10*time.Millisecond) || s.PackageLost != 0.5 {
+		t.Fatal("Error record.", s.ReceivedPackageCount, s.Latency, s.PackageLost)
+	}
+}
@@ -0,0 +1,300 @@
+package udp
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Legacy (version 0) packages start directly with the package type byte.
+// Versioned packages start with ProtocolMagic, which never collides with a
+// legacy package type, followed by the version, the package type and the
+// capabilities of the sender. Starting with AuthVersion every versioned
+// package ends with a truncated HMAC-SHA256 over header and payload, and sync
+// packages no longer carry the token. Starting with ReplayVersion the header
+// also carries the sequence number and send time of the package, and starting
+// with IdentityVersion the identity whose key signed it. Starting with
+// NodeVersion sync packages describe the sender node and carry node ids, and
+// starting with FragmentVersion they carry the message id and the fragment
+// index and count, so a message split over several packages is applied as a
+// whole. Starting with DeltaVersion sync messages carry peer state versions
+// and may only list what changed. Starting with ClockVersion echo replies
+// carry both the receive and the reply time of the remote server, and
+// starting with GoodbyeVersion servers announce when they shut down.
+// Starting with RegisterVersion clients register at the center, which
+// answers with its parameters or why it refused them, and starting with
+// ParametersVersion sync packages carry the parameters of the sender.
+// Starting with LeaseVersion the leader of several centers announces its
+// lease, which the other centers acknowledge, and starting with GossipVersion peers may exchange their peer lists
+// and probe silent peers for each other.
+const ProtocolMagic = 0xC5
+const ProtocolVersion = 13
+const AuthVersion = 2
+const ReplayVersion = 3
+const IdentityVersion = 4
+const NodeVersion = 5
+const FragmentVersion = 6
+const DeltaVersion = 7
+const ClockVersion = 8
+const GoodbyeVersion = 9
+const RegisterVersion = 10
+const ParametersVersion = 11
+const LeaseVersion = 12
+const GossipVersion = 13
+const HeaderLength = 7
+const ReplayHeaderLength = 23
+const IdentityHeaderLength = 27
+const MacLength = 16
+
+const (
+	PackageTypeEchoRequest  = 0
+	PackageTypeEchoReply    = 1
+	PackageTypeSync         = 2
+	PackageTypeGoodbye      = 3
+	PackageTypeRegister     = 4
+	PackageTypeRegisterAck  = 5
+	PackageTypeLease        = 6
+	PackageTypeGossip       = 7
+	PackageTypeProbeRequest = 8
+	PackageTypeProbeReply   = 9
+	PackageTypeLeaseAck     = 10
+)
+
+// TypeEncrypted is set in the package type of versioned packages whose
+// payload is encrypted.
+const TypeEncrypted = 0x80
+
+const (
+	CapabilityIPv6 = 1 << iota
+	CapabilityEncryption
+)
+
+// LocalCapabilities is what this node supports. CapabilityEncryption is only
+// set once encrypt keys are loaded.
+var LocalCapabilities uint32 = CapabilityIPv6
+
+var authKey []byte
+var localIdentity uint32
+var localIdentityKey []byte
+var credentials *CredentialStore
+
+// sequence is initialised from the clock so it keeps growing across restarts.
+var sequence = uint64(time.Now().UnixNano())
+
+func nextSequence() uint64 {
+	return atomic.AddUint64(&sequence, 1)
+}
+
+// SetKey sets the pre-shared key used to sign and verify packages.
+func SetKey(key []byte) {
+	authKey = key
+}
+
+// SetIdentity sets the credential of this client, used with the center.
+func SetIdentity(identity uint32, key []byte) {
+	localIdentity = identity
+	localIdentityKey = key
+}
+
+// SetCredentials sets the registry the center verifies client packages with.
+func SetCredentials(store *CredentialStore) {
+	credentials = store
+}
+
+func keyFor(identity uint32) ([]byte, error) {
+	if identity == 0 {
+		return authKey, nil
+	}
+	if identity == localIdentity {
+		return localIdentityKey, nil
+	}
+	if credentials != nil {
+		return credentials.Key(identity)
+	}
+	return nil, ErrUnknownIdentity
+}
+
+func sign(key []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)[:MacLength]
+}
+
+type Header struct {
+	Version       byte
+	Type          byte
+	Capabilities  uint32
+	Sequence      uint64
+	Timestamp     int64
+	Identity      uint32
+	Encrypted     bool
+	Authenticated bool
+	AuthError     error
+}
+
+// Errors of packages which don't authenticate. LoadHeader still returns
+// their header, so registrations can answer with the reason.
+var (
+	ErrWrongSignature  = errors.New("Wrong package signature.")
+	ErrUnknownIdentity = errors.New("Unknown identity.")
+	ErrRevokedIdentity = errors.New("Identity revoked.")
+)
+
+func (s *Header) Length() int {
+	if s.Version == 0 {
+		return 1
+	}
+	if s.Version >= IdentityVersion {
+		return IdentityHeaderLength
+	}
+	if s.Version >= ReplayVersion {
+		return ReplayHeaderLength
+	}
+	return HeaderLength
+}
+
+// ToData allocates a package with room for payloadLength bytes after the
+// header, and returns it together with the payload offset.
+func (s *Header) ToData(payloadLength int) ([]byte, int) {
+	data := make([]byte, s.Length()+payloadLength)
+	if s.Version == 0 {
+		data[0] = s.Type
+		return data, 1
+	}
+	data[0] = ProtocolMagic
+	data[1] = s.Version
+	data[2] = s.Type
+	if s.Encrypted {
+		data[2] |= TypeEncrypted
+	}
+	binary.BigEndian.PutUint32(data[3:7], s.Capabilities)
+	if s.Version >= ReplayVersion {
+		s.Sequence = nextSequence()
+		s.Timestamp = time.Now().UnixNano()
+		binary.BigEndian.PutUint64(data[7:15], s.Sequence)
+		binary.BigEndian.PutUint64(data[15:23], uint64(s.Timestamp))
+	}
+	if s.Version >= IdentityVersion {
+		binary.BigEndian.PutUint32(data[23:27], s.Identity)
+	}
+	return data, s.Length()
+}
+
+// Seal encrypts the payload of a package built with ToData if needed, then
+// appends the signature when the version requires one. It returns nil when
+// there is no key to sign with, such packages are never sent.
+func (s *Header) Seal(data []byte) []byte {
+	if s.Encrypted {
+		data = append(data[:s.Length():s.Length()], encrypt(data[:s.Length()], data[s.Length():])...)
+	}
+	if s.Version < AuthVersion {
+		return data
+	}
+	key, err := keyFor(s.Identity)
+	if err != nil {
+		log.Warning("Can't sign package for identity %d. %s", s.Identity, err.Error())
+		return nil
+	}
+	return append(data, sign(key, data)...)
+}
+
+// Overhead is the number of bytes Seal adds.
+func (s *Header) Overhead() int {
+	overhead := 0
+	if s.Encrypted {
+		overhead += EncryptOverhead
+	}
+	if s.Version >= AuthVersion {
+		overhead += MacLength
+	}
+	return overhead
+}
+
+// LoadHeader parses the header of data and returns the payload after it.
+func LoadHeader(data []byte) (*Header, []byte, error) {
+	if len(data) < 1 {
+		return nil, nil, errors.New("Empty package.")
+	}
+	if data[0] != ProtocolMagic {
+		return &Header{Version: 0, Type: data[0]}, data[1:], nil
+	}
+	if len(data) < HeaderLength {
+		return nil, nil, errors.New("Header truncated.")
+	}
+	header := &Header{
+		Version:      data[1],
+		Type:         data[2] &^ TypeEncrypted,
+		Capabilities: binary.BigEndian.Uint32(data[3:7]),
+		Encrypted:    data[2]&TypeEncrypted != 0}
+	if header.Version == 0 || header.Version > ProtocolVersion {
+		return nil, nil, errors.New("Unsupported protocol version.")
+	}
+	if len(data) < header.Length() {
+		return nil, nil, errors.New("Header truncated.")
+	}
+	if header.Version >= ReplayVersion {
+		header.Sequence = binary.BigEndian.Uint64(data[7:15])
+		header.Timestamp = int64(binary.BigEndian.Uint64(data[15:23]))
+	}
+	if header.Version >= IdentityVersion {
+		header.Identity = binary.BigEndian.Uint32(data[23:27])
+	}
+	if header.Version >= AuthVersion {
+		if len(data) < header.Length()+MacLength {
+			return nil, nil, errors.New("Signature truncated.")
+		}
+		body := data[:len(data)-MacLength]
+		key, err := keyFor(header.Identity)
+		if err == nil && !hmac.Equal(sign(key, body), data[len(body):]) {
+			err = ErrWrongSignature
+		}
+		if err != nil {
+			header.AuthError = err
+			if header.Encrypted {
+				return header, nil, err
+			}
+			return header, body[header.Length():], err
+		}
+		header.Authenticated = true
+		data = body
+	}
+	if header.Encrypted {
+		payload, err := decrypt(data[:header.Length()], data[header.Length():])
+		if err != nil {
+			return nil, nil, err
+		}
+		return header, payload, nil
+	}
+	return header, data[header.Length():], nil
+}
+
+// NewHeader builds the header used to talk to a peer which announced version
+// and capabilities, downgrading to what both sides support.
+func NewHeader(packageType byte, version byte, capabilities uint32) *Header {
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if version == 0 {
+		return &Header{Version: 0, Type: packageType}
+	}
+	encrypted := confidential(packageType) && Negotiate(capabilities)&CapabilityEncryption != 0
+	return &Header{Version: version, Type: packageType, Capabilities: LocalCapabilities, Encrypted: encrypted}
+}
+
+// confidential tells if packages of packageType describe the peers, their
+// payload is encrypted when both sides can.
+func confidential(packageType byte) bool {
+	switch packageType {
+	case PackageTypeSync, PackageTypeGossip, PackageTypeProbeRequest, PackageTypeProbeReply:
+		return true
+	}
+	return false
+}
+
+// Negotiate returns the capabilities supported by both sides.
+func Negotiate(capabilities uint32) uint32 {
+	return capabilities & LocalCapabilities
+}
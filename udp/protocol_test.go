@@ -0,0 +1,276 @@
+package udp
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"github.com/Catofes/go-its/config"
+)
+
+// legacySync builds a sync package exactly as clients before the versioned
+// protocol did.
+func legacySync(self net.IP, port uint16, token uint64, servers []ServerInfo) []byte {
+	data := make([]byte, 15+26*len(servers))
+	data[0] = 2
+	copy(data[1:5], self.To4())
+	binary.BigEndian.PutUint16(data[5:7], port)
+	binary.BigEndian.PutUint64(data[7:15], token)
+	for i, server := range servers {
+		start := 15 + i*26
+		copy(data[start:start+4], server.Ip.To4())
+		binary.BigEndian.PutUint16(data[start+4:start+6], server.Port)
+		binary.BigEndian.PutUint64(data[start+6:start+14], server.Latency)
+		binary.BigEndian.PutUint32(data[start+14:start+18], math.Float32bits(server.PackageLost))
+		binary.BigEndian.PutUint64(data[start+18:start+26], server.LastOnline)
+	}
+	return data
+}
+
+func TestLoadLegacySync(t *testing.T) {
+	server := ServerInfo{Ip: net.ParseIP("10.3.5.6"), Port: 333, Latency: 184932, PackageLost: 0.5, LastOnline: 42}
+	data := legacySync(net.ParseIP("222.29.47.158"), 555, 123, []ServerInfo{server})
+	header, payload, err := LoadHeader(data)
+	if err != nil {
+		t.Fatal("Load header failed.", err)
+	}
+	if header.Version != 0 || header.Type != PackageTypeSync {
+		t.Fatal("Error legacy header.", header)
+	}
+	p := (&SyncPackage{}).Init()
+	if err := p.LoadFromData(header, payload); err != nil {
+		t.Fatal("Load legacy sync failed.", err)
+	}
+	if !p.Self.Ip.Equal(net.ParseIP("222.29.47.158")) || p.Self.Port != 555 || p.Token != 123 {
+		t.Fatal("Error legacy self.", p.Self, p.Token)
+	}
+	v, _ := p.Servers.Pop()
+	r := v.(*ServerInfo)
+	if !r.Ip.Equal(server.Ip) || r.Port != server.Port || r.Latency != server.Latency ||
+		r.PackageLost != server.PackageLost || r.LastOnline != server.LastOnline || r.Version != 0 {
+		t.Fatal("Error legacy server.", r)
+	}
+}
+
+func TestLegacySyncReply(t *testing.T) {
+	p := (&SyncPackage{}).Init()
+	p.Self.Ip = net.ParseIP("222.29.47.158")
+	p.Self.Port = 555
+	p.Token = 123
+	v4 := ServerInfo{Ip: net.ParseIP("10.3.5.6"), Port: 333, Latency: 184932, PackageLost: 0.5, LastOnline: 42, Version: 1}
+	v6 := ServerInfo{Ip: net.ParseIP("2001:da8:201::1"), Port: 444, Version: 1}
+	p.Servers.Push(&v6)
+	p.Servers.Push(&v4)
+	d, n := p.ToData(NewHeader(PackageTypeSync, 0, 0))
+	if n != 1 {
+		t.Fatal("Error package count.", n)
+	}
+	expected := legacySync(p.Self.Ip, p.Self.Port, p.Token, []ServerInfo{v4})
+	if string(d[0]) != string(expected) {
+		t.Fatal("Legacy sync differs.", d[0], expected)
+	}
+}
+
+func TestLegacySyncRegisters(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	if err := ioutil.WriteFile(file, []byte(`{"Token": 123}`), 0600); err != nil {
+		t.Fatal("Write config failed.", err)
+	}
+	if config.GetInstance(file).Token != 123 {
+		t.Skip("Another config is loaded.")
+	}
+	udpService = &UdpService{isServer: true}
+	defer func() { udpService = nil }()
+	s := &MainService{Servers: make(map[string]*RemoteServer), maxAge: time.Minute}
+	s.reassembler = (&Reassembler{}).Init(time.Second)
+	address := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	sync := func(data []byte) {
+		header, payload, err := LoadHeader(data)
+		if err != nil {
+			t.Fatal("Load header failed.", err)
+		}
+		message, err := DecodeSync(header, payload)
+		if err != nil {
+			t.Fatal("Decode sync failed.", err)
+		}
+		s.syncHandler(&Request{nil, address, header, payload, message})
+	}
+
+	// The first package of a legacy client registers it.
+	sync(legacySync(address.IP, 1000, 123, nil))
+	v, ok := s.Servers[nodeKey(NodeId{}, address.IP, 1000)]
+	if !ok || v.Version != 0 || !v.negotiated {
+		t.Fatal("Legacy client not registered.", s.Servers)
+	}
+	sync(legacySync(address.IP, 1000, 123, nil))
+	if len(s.Servers) != 1 {
+		t.Fatal("Legacy client registered twice.", len(s.Servers))
+	}
+
+	// A server which talked authenticated packages can't be downgraded.
+	v.negotiate(NewHeader(PackageTypeSync, ProtocolVersion, 0))
+	if v.accept(&Header{Version: 0, Type: PackageTypeSync}, time.Minute) {
+		t.Fatal("Downgraded package accepted.")
+	}
+}
+
+func TestLegacyEchoRequest(t *testing.T) {
+	center, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("Can't listen udp.", err)
+	}
+	defer center.Close()
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("Can't listen udp.", err)
+	}
+	defer client.Close()
+
+	request := make([]byte, EchoPackageLength)
+	binary.BigEndian.PutUint32(request[1:5], 7)
+	binary.BigEndian.PutUint64(request[5:13], 99)
+	header, payload, err := LoadHeader(request)
+	if err != nil {
+		t.Fatal("Load header failed.", err)
+	}
+	// Unauthenticated echo requests are only answered for known peers.
+	address := client.LocalAddr().(*net.UDPAddr)
+	service = &MainService{Servers: map[string]*RemoteServer{"client": (&RemoteServer{}).Init(address.IP, uint16(address.Port))}}
+	defer func() { service = nil }()
+	message, _ := DecodeEcho(header, payload)
+	EchoRequestHandler(&Request{center, address, header, payload, message})
+
+	reply := make([]byte, 1024)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := client.ReadFromUDP(reply)
+	if err != nil {
+		t.Fatal("Read reply failed.", err)
+	}
+	if n != EchoPackageLength || reply[0] != PackageTypeEchoReply {
+		t.Fatal("Error legacy reply.", reply[:n])
+	}
+	if binary.BigEndian.Uint32(reply[1:5]) != 7 || binary.BigEndian.Uint64(reply[5:13]) != 99 ||
+		binary.BigEndian.Uint64(reply[13:21]) == 0 {
+		t.Fatal("Error legacy reply content.", reply[:n])
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	header := NewHeader(PackageTypeEchoRequest, ProtocolVersion+1, 0xffffffff)
+	if header.Version != ProtocolVersion || header.Capabilities != LocalCapabilities {
+		t.Fatal("Error downgrade.", header)
+	}
+	data, _ := header.ToData(0)
+	r, _, err := LoadHeader(header.Seal(data))
+	if err != nil || r.Version != header.Version || r.Type != header.Type ||
+		r.Capabilities != header.Capabilities || !r.Authenticated {
+		t.Fatal("Error header round trip.", r, err)
+	}
+	if Negotiate(0xffffffff) != LocalCapabilities || Negotiate(0) != 0 {
+		t.Fatal("Error capabilities.")
+	}
+	data[1] = ProtocolVersion + 1
+	if _, _, err := LoadHeader(data); err == nil {
+		t.Fatal("Accepted unsupported version.")
+	}
+}
+
+func TestSealUnknownIdentity(t *testing.T) {
+	header := NewHeader(PackageTypeEchoRequest, ProtocolVersion, 0)
+	header.Identity = 77
+	if data := (&EchoPackage{Id: 1}).ToData(header); data != nil {
+		t.Fatal("Package sealed without a key.", data)
+	}
+	if _, err := (&UdpService{}).WriteToUDP(nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}); err == nil {
+		t.Fatal("Empty package sent.")
+	}
+}
+
+func TestSignedSync(t *testing.T) {
+	SetKey([]byte("secret"))
+	defer SetKey(nil)
+	p := (&SyncPackage{}).Init()
+	p.Self.Ip = net.ParseIP("222.29.47.158")
+	p.Self.Port = 555
+	p.Token = 0x0123456789abcdef
+	p.Servers.Push(&ServerInfo{Ip: net.ParseIP("10.3.5.6"), Port: 333})
+	d, _ := p.ToData(NewHeader(PackageTypeSync, ProtocolVersion, LocalCapabilities))
+	token := make([]byte, 8)
+	binary.BigEndian.PutUint64(token, p.Token)
+	if strings.Contains(string(d[0]), string(token)) {
+		t.Fatal("Token sent in clear.")
+	}
+	header, payload, err := LoadHeader(d[0])
+	if err != nil || !header.Authenticated {
+		t.Fatal("Load signed sync failed.", err)
+	}
+	r := (&SyncPackage{}).Init()
+	if err := r.LoadFromData(header, payload); err != nil || r.Token != 0 || r.Servers.Size() != 1 {
+		t.Fatal("Error signed sync.", err, r.Token, r.Servers.Size())
+	}
+	for i := 1; i < len(d[0]); i++ {
+		tampered := append([]byte{}, d[0]...)
+		tampered[i] ^= 1
+		if _, _, err := LoadHeader(tampered); err == nil {
+			t.Fatal("Accepted tampered package at byte", i)
+		}
+	}
+	SetKey([]byte("other"))
+	if _, _, err := LoadHeader(d[0]); err == nil {
+		t.Fatal("Accepted package signed with another key.")
+	}
+}
+
+func TestEncryptedSync(t *testing.T) {
+	oldKey := "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	newKey := "1f1e1d1c1b1a191817161514131211100f0e0d0c0b0a09080706050403020100"
+	if err := SetEncryptKeys([]string{oldKey}); err != nil {
+		t.Fatal("Load key failed.", err)
+	}
+	defer SetEncryptKeys(nil)
+	p := (&SyncPackage{}).Init()
+	p.Self.Ip = net.ParseIP("222.29.47.158")
+	p.Self.Port = 555
+	p.Servers.Push(&ServerInfo{Ip: net.ParseIP("10.3.5.6"), Port: 333})
+	header := NewHeader(PackageTypeSync, ProtocolVersion, LocalCapabilities)
+	if !header.Encrypted {
+		t.Fatal("Sync not encrypted.")
+	}
+	d, _ := p.ToData(header)
+	if strings.Contains(string(d[0]), string(net.ParseIP("10.3.5.6").To4())) {
+		t.Fatal("Server sent in clear.")
+	}
+
+	// During rollover the new key encrypts and the old one is still accepted.
+	if err := SetEncryptKeys([]string{newKey, oldKey}); err != nil {
+		t.Fatal("Load keys failed.", err)
+	}
+	h, payload, err := LoadHeader(d[0])
+	if err != nil || !h.Encrypted || h.Type != PackageTypeSync {
+		t.Fatal("Decrypt with old key failed.", err)
+	}
+	r := (&SyncPackage{}).Init()
+	if err := r.LoadFromData(h, payload); err != nil || r.Servers.Size() != 1 || r.Self.Port != 555 {
+		t.Fatal("Error encrypted sync.", err)
+	}
+
+	if err := SetEncryptKeys([]string{newKey}); err != nil {
+		t.Fatal("Load key failed.", err)
+	}
+	if _, _, err := LoadHeader(d[0]); err == nil {
+		t.Fatal("Accepted package encrypted with a retired key.")
+	}
+	if NewHeader(PackageTypeEchoRequest, ProtocolVersion, LocalCapabilities).Encrypted {
+		t.Fatal("Echo encrypted.")
+	}
+	if NewHeader(PackageTypeSync, ProtocolVersion, CapabilityIPv6).Encrypted {
+		t.Fatal("Encrypted for a peer without the capability.")
+	}
+	if err := SetEncryptKeys([]string{oldKey, newKey, oldKey}); err == nil {
+		t.Fatal("Accepted three keys.")
+	}
+}
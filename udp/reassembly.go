@@ -0,0 +1,83 @@
+package udp
+
+import (
+	"strconv"
+	"time"
+)
+
+// MaxPendingMessages bounds the sync messages waiting for fragments.
+const MaxPendingMessages = 256
+
+type fragmentSet struct {
+	created  time.Time
+	received int
+	headers  []*Header
+	packages []*SyncPackage
+}
+
+// Reassembler collects the fragments of sync messages, so a message is only
+// applied once all its packages arrived. Incomplete messages are dropped
+// after timeout.
+type Reassembler struct {
+	pending map[string]*fragmentSet
+	timeout time.Duration
+	Expired int64
+}
+
+func (s *Reassembler) Init(timeout time.Duration) *Reassembler {
+	s.pending = make(map[string]*fragmentSet)
+	s.timeout = timeout
+	return s
+}
+
+func (s *Reassembler) expire(now time.Time) {
+	for k, v := range s.pending {
+		if now.Sub(v.created) > s.timeout {
+			log.Info("Drop incomplete sync message %s, %d/%d fragments.", k, v.received, len(v.packages))
+			delete(s.pending, k)
+			s.Expired++
+		}
+	}
+}
+
+// Add stores one fragment received from sender. Once the message is complete
+// it returns the merged package and the headers of all its fragments.
+func (s *Reassembler) Add(sender string, header *Header, p *SyncPackage) (*SyncPackage, []*Header) {
+	if header.Version < FragmentVersion || p.Total == 1 {
+		return p, []*Header{header}
+	}
+	now := time.Now()
+	s.expire(now)
+	key := sender + "/" + strconv.FormatUint(uint64(p.MessageId), 10)
+	set, ok := s.pending[key]
+	if !ok {
+		if len(s.pending) >= MaxPendingMessages {
+			log.Warning("Too many incomplete sync messages, drop fragment from %s.", sender)
+			return nil, nil
+		}
+		set = &fragmentSet{now, 0, make([]*Header, p.Total), make([]*SyncPackage, p.Total)}
+		s.pending[key] = set
+	}
+	if int(p.Total) != len(set.packages) {
+		log.Warning("Fragment count of sync message %s changed.", key)
+		delete(s.pending, key)
+		return nil, nil
+	}
+	if set.packages[p.Index] != nil {
+		return nil, nil
+	}
+	set.headers[p.Index] = header
+	set.packages[p.Index] = p
+	set.received++
+	if set.received < len(set.packages) {
+		return nil, nil
+	}
+	delete(s.pending, key)
+	result := set.packages[0]
+	for _, v := range set.packages[1:] {
+		for _, server := range v.Servers.Values() {
+			result.Servers.Push(server)
+		}
+	}
+	return result, set.headers
+}
@@ -0,0 +1,74 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func syncFragments(t *testing.T, count int) ([]*Header, []*SyncPackage) {
+	p := (&SyncPackage{}).Init()
+	p.Self.Ip = net.ParseIP("222.29.47.158")
+	for i := 0; i < count; i++ {
+		p.Servers.Push(&ServerInfo{Ip: net.IPv4(10, 3, 5, byte(i)), Port: uint16(i), NodeId: NodeId{byte(i)}})
+	}
+	d, n := p.ToData(NewHeader(PackageTypeSync, ProtocolVersion, LocalCapabilities))
+	headers := make([]*Header, n)
+	packages := make([]*SyncPackage, n)
+	for i := 0; i < n; i++ {
+		header, payload, err := LoadHeader(d[i])
+		if err != nil {
+			t.Fatal("Load header failed.", err)
+		}
+		packages[i] = (&SyncPackage{}).Init()
+		if err := packages[i].LoadFromData(header, payload); err != nil {
+			t.Fatal("Load sync failed.", err)
+		}
+		headers[i] = header
+	}
+	return headers, packages
+}
+
+func TestReassembler(t *testing.T) {
+	headers, packages := syncFragments(t, 60)
+	if len(packages) < 3 {
+		t.Fatal("Expected several fragments.", len(packages))
+	}
+	r := (&Reassembler{}).Init(time.Minute)
+	for i := len(packages) - 1; i > 0; i-- {
+		if p, _ := r.Add("a", headers[i], packages[i]); p != nil {
+			t.Fatal("Applied incomplete message.")
+		}
+	}
+	if p, _ := r.Add("a", headers[1], packages[1]); p != nil {
+		t.Fatal("Applied duplicate fragment.")
+	}
+	p, h := r.Add("a", headers[0], packages[0])
+	if p == nil || p.Servers.Size() != 60 || len(h) != len(packages) {
+		t.Fatal("Error reassembled message.", p, h)
+	}
+
+	headers, packages = syncFragments(t, 60)
+	r = (&Reassembler{}).Init(10 * time.Millisecond)
+	r.Add("a", headers[0], packages[0])
+	time.Sleep(20 * time.Millisecond)
+	for i := 1; i < len(packages); i++ {
+		if p, _ := r.Add("a", headers[i], packages[i]); p != nil {
+			t.Fatal("Applied message with an expired fragment.")
+		}
+	}
+	if r.Expired != 1 {
+		t.Fatal("Error expired count.", r.Expired)
+	}
+}
+
+func TestEmptySync(t *testing.T) {
+	headers, packages := syncFragments(t, 0)
+	if len(packages) != 1 || packages[0].Total != 1 || packages[0].Servers.Size() != 0 {
+		t.Fatal("Error empty sync.", len(packages))
+	}
+	p, _ := (&Reassembler{}).Init(time.Minute).Add("a", headers[0], packages[0])
+	if p == nil {
+		t.Fatal("Empty sync not applied.")
+	}
+}
@@ -0,0 +1,149 @@
+package udp
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// Codes of a RegisterAck.
+const (
+	RegisterOK = iota
+	RegisterWrongKey
+	RegisterUnknownIdentity
+	RegisterRevokedIdentity
+	RegisterIdentityRequired
+)
+
+var registerReasons = []string{
+	"registered",
+	"wrong key or token",
+	"unknown identity",
+	"identity revoked",
+	"identity required",
+}
+
+// Refusals are answered at most RefusalRate times per second per source, with
+// bursts of up to RefusalBurst.
+const (
+	RefusalRate  = 0.2
+	RefusalBurst = 3
+)
+
+// RegisterReason describes a RegisterAck code.
+func RegisterReason(code byte) string {
+	if int(code) < len(registerReasons) {
+		return registerReasons[code]
+	}
+	return "unknown reason"
+}
+
+// registerCode is the code answering a registration which failed to
+// authenticate with err.
+func registerCode(err error) byte {
+	switch err {
+	case nil:
+		return RegisterOK
+	case ErrUnknownIdentity:
+		return RegisterUnknownIdentity
+	case ErrRevokedIdentity:
+		return RegisterRevokedIdentity
+	}
+	return RegisterWrongKey
+}
+
+// RegisterPackage announces a client to the center.
+type RegisterPackage struct {
+	Node NodeInfo
+}
+
+func (s *RegisterPackage) ToData(header *Header) []byte {
+	data, start := header.ToData(s.Node.length())
+	s.Node.toData(data[start:])
+	return header.Seal(data)
+}
+
+func (s *RegisterPackage) LoadFromData(header *Header, data []byte) error {
+	if header.Version < RegisterVersion {
+		return errors.New("Wrong package version.")
+	}
+	length, err := s.Node.loadFromData(data)
+	if err != nil {
+		return err
+	}
+	if length != len(data) {
+		return errors.New("Wrong package size.")
+	}
+	return nil
+}
+
+// RegisterAckLength is the fixed part of a RegisterAck, the address adds
+// addressLength bytes.
+const RegisterAckLength = 19
+
+// RegisterAck answers a registration. Identity is the identity the center
+// verified the client with, Ip and Port where it sees the client, and the
+// durations in milliseconds are the parameters of the center. On errors
+// only Code is set.
+type RegisterAck struct {
+	Code        byte
+	Identity    uint32
+	Ip          net.IP
+	Port        uint16
+	PingEvery   uint32
+	SyncEvery   uint32
+	OfflineTime uint32
+}
+
+func (s *RegisterAck) ToData(header *Header) []byte {
+	data, start := header.ToData(RegisterAckLength + addressLength(s.Ip))
+	data[start] = s.Code
+	binary.BigEndian.PutUint32(data[start+1:start+5], s.Identity)
+	start += 5
+	start += putAddress(data[start:], s.Ip)
+	binary.BigEndian.PutUint16(data[start:start+2], s.Port)
+	binary.BigEndian.PutUint32(data[start+2:start+6], s.PingEvery)
+	binary.BigEndian.PutUint32(data[start+6:start+10], s.SyncEvery)
+	binary.BigEndian.PutUint32(data[start+10:start+14], s.OfflineTime)
+	return header.Seal(data)
+}
+
+func (s *RegisterAck) LoadFromData(header *Header, data []byte) error {
+	if header.Version < RegisterVersion || len(data) < RegisterAckLength {
+		return errors.New("Wrong package size.")
+	}
+	s.Code = data[0]
+	s.Identity = binary.BigEndian.Uint32(data[1:5])
+	ip, length, err := readAddress(data[5:])
+	if err != nil {
+		return err
+	}
+	if len(data) != RegisterAckLength+length {
+		return errors.New("Wrong package size.")
+	}
+	s.Ip = ip
+	start := 5 + length
+	s.Port = binary.BigEndian.Uint16(data[start : start+2])
+	s.PingEvery = binary.BigEndian.Uint32(data[start+2 : start+6])
+	s.SyncEvery = binary.BigEndian.Uint32(data[start+6 : start+10])
+	s.OfflineTime = binary.BigEndian.Uint32(data[start+10 : start+14])
+	return nil
+}
+
+// DecodeRegister is the codec of registrations.
+func DecodeRegister(header *Header, payload []byte) (interface{}, error) {
+	p := &RegisterPackage{}
+	if err := p.LoadFromData(header, payload); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// DecodeRegisterAck is the codec of registration answers.
+func DecodeRegisterAck(header *Header, payload []byte) (interface{}, error) {
+	p := &RegisterAck{}
+	if err := p.LoadFromData(header, payload); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
@@ -0,0 +1,169 @@
+package udp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRegisterAckParser(t *testing.T) {
+	ack := RegisterAck{RegisterOK, 7, net.ParseIP("2001:db8::1"), 4000, 500, 2000, 5000}
+	header := NewHeader(PackageTypeRegisterAck, ProtocolVersion, 0)
+	h, payload, err := LoadHeader(ack.ToData(header))
+	if err != nil {
+		t.Fatal("Load header failed.", err)
+	}
+	r, err := DecodeRegisterAck(h, payload)
+	if err != nil {
+		t.Fatal("Decode failed.", err)
+	}
+	got := r.(*RegisterAck)
+	if !got.Ip.Equal(ack.Ip) || got.Port != ack.Port || got.Identity != 7 || got.PingEvery != 500 ||
+		got.SyncEvery != 2000 || got.OfflineTime != 5000 {
+		t.Fatal("Ack differs.", got)
+	}
+	if _, err := DecodeRegisterAck(h, payload[:len(payload)-1]); err == nil {
+		t.Fatal("Truncated ack accepted.")
+	}
+	if _, err := DecodeRegisterAck(&Header{Version: GoodbyeVersion}, payload); err == nil {
+		t.Fatal("Ack accepted before RegisterVersion.")
+	}
+}
+
+func TestRegisterCode(t *testing.T) {
+	for err, code := range map[error]byte{
+		nil:                RegisterOK,
+		ErrWrongSignature:  RegisterWrongKey,
+		ErrUnknownIdentity: RegisterUnknownIdentity,
+		ErrRevokedIdentity: RegisterRevokedIdentity,
+	} {
+		if registerCode(err) != code {
+			t.Fatal("Error code.", err)
+		}
+	}
+	if RegisterReason(RegisterRevokedIdentity) != "identity revoked" || RegisterReason(200) != "unknown reason" {
+		t.Fatal("Error reason.")
+	}
+}
+
+// register sends a registration of node signed with key to center, and
+// returns the answer.
+func register(t *testing.T, s *MainService, center *net.UDPConn, client *net.UDPConn, key string, node NodeInfo) *RegisterAck {
+	SetKey([]byte(key))
+	data := (&RegisterPackage{node}).ToData(NewHeader(PackageTypeRegister, ProtocolVersion, 0))
+	SetKey([]byte("secret"))
+	header, payload, err := LoadHeader(data)
+	if header == nil {
+		t.Fatal("Load header failed.", err)
+	}
+	message, err := DecodeRegister(header, payload)
+	if err != nil {
+		t.Fatal("Decode failed.", err)
+	}
+	s.registerHandler(&Request{center, client.LocalAddr().(*net.UDPAddr), header, payload, message})
+
+	buffer := make([]byte, 1024)
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := client.ReadFromUDP(buffer)
+	if err != nil {
+		t.Fatal("Read ack failed.", err)
+	}
+	header, payload, err = LoadHeader(buffer[:n])
+	if err != nil {
+		t.Fatal("Load ack failed.", err)
+	}
+	ack, err := DecodeRegisterAck(header, payload)
+	if err != nil {
+		t.Fatal("Decode ack failed.", err)
+	}
+	return ack.(*RegisterAck)
+}
+
+func TestRegisterHandler(t *testing.T) {
+	center, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("Can't listen udp.", err)
+	}
+	defer center.Close()
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip("Can't listen udp.", err)
+	}
+	defer client.Close()
+	defer SetKey(nil)
+	udpService = &UdpService{isServer: true}
+	defer func() { udpService = nil }()
+	s := &MainService{Servers: make(map[string]*RemoteServer), maxAge: time.Minute,
+		pingEvery: 500 * time.Millisecond, syncEvery: 2 * time.Second, offlineTime: 5 * time.Second,
+		refusals: (&RateLimiter{}).Init(RefusalRate, RefusalBurst)}
+	node := NodeInfo{NodeId{9}, "client", nil}
+
+	ack := register(t, s, center, client, "wrong", node)
+	if ack.Code != RegisterWrongKey || len(s.Servers) != 0 {
+		t.Fatal("Wrong key registered.", ack.Code)
+	}
+	ack = register(t, s, center, client, "secret", node)
+	address := client.LocalAddr().(*net.UDPAddr)
+	if ack.Code != RegisterOK || ack.PingEvery != 500 || ack.SyncEvery != 2000 || ack.OfflineTime != 5000 ||
+		!ack.Ip.Equal(address.IP) || int(ack.Port) != address.Port {
+		t.Fatal("Error ack.", ack)
+	}
+	if v, ok := s.Servers[node.Id.String()]; !ok || v.Name != "client" {
+		t.Fatal("Client not registered.")
+	}
+	udpService.RequireIdentity = true
+	if ack = register(t, s, center, client, "secret", NodeInfo{NodeId{10}, "", nil}); ack.Code != RegisterIdentityRequired {
+		t.Fatal("Registered without identity.", ack.Code)
+	}
+
+	// The burst of refusals is used up, further ones are dropped.
+	register(t, s, center, client, "wrong", node)
+	before := Drops().RateLimited
+	SetKey([]byte("wrong"))
+	data := (&RegisterPackage{node}).ToData(NewHeader(PackageTypeRegister, ProtocolVersion, 0))
+	SetKey([]byte("secret"))
+	header, payload, _ := LoadHeader(data)
+	message, _ := DecodeRegister(header, payload)
+	s.registerHandler(&Request{center, address, header, payload, message})
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := client.ReadFromUDP(make([]byte, 1024)); err == nil || Drops().RateLimited != before+1 {
+		t.Fatal("Refusal not rate limited.")
+	}
+}
+
+func TestRegisterAckHandler(t *testing.T) {
+	address := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}
+	center := (&RemoteServer{}).Init(address.IP, uint16(address.Port))
+	center.Center = true
+	s := &MainService{Servers: map[string]*RemoteServer{"center": center}, maxAge: time.Minute}
+	s.election = (&Election{}).Init(NodeId{9}, time.Second, false, 1, time.Now())
+	request := func(ack RegisterAck, authenticated bool) *Request {
+		header := NewHeader(PackageTypeRegisterAck, ProtocolVersion, 0)
+		h, payload, _ := LoadHeader(ack.ToData(header))
+		h.Authenticated = authenticated
+		message, _ := DecodeRegisterAck(h, payload)
+		return &Request{nil, address, h, payload, message}
+	}
+
+	s.registerAckHandler(request(RegisterAck{Code: RegisterOK, Ip: net.ParseIP("10.0.0.2")}, false))
+	if center.registered {
+		t.Fatal("Unauthenticated ack registered.")
+	}
+	s.registerAckHandler(request(RegisterAck{Code: RegisterOK, Ip: net.ParseIP("10.0.0.2"), PingEvery: 500}, true))
+	if !center.registered || s.Registration.PingEvery != 500 || !s.ip.Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatal("Ack not applied.")
+	}
+	if s.pingEvery != 500*time.Millisecond || s.syncEvery != 0 {
+		t.Fatal("Parameters not applied.", s.pingEvery, s.syncEvery)
+	}
+
+	// Anyone can send unauthenticated refusals, they are only logged.
+	s.registerAckHandler(request(RegisterAck{Code: RegisterRevokedIdentity}, false))
+	if !center.registered || s.Registration.Code != RegisterOK {
+		t.Fatal("Unauthenticated refusal applied.")
+	}
+	s.registerAckHandler(request(RegisterAck{Code: RegisterRevokedIdentity}, true))
+	if center.registered || s.Registration.Code != RegisterRevokedIdentity {
+		t.Fatal("Refusal not recorded.")
+	}
+}
@@ -0,0 +1,63 @@
+package udp
+
+import (
+	"errors"
+	"time"
+)
+
+// ReplayWindowSize is how many sequence numbers below the highest one seen
+// are still accepted, to tolerate reordering.
+const ReplayWindowSize = 64
+
+// ReplayWindow rejects packages from one sender whose sequence number was
+// already seen or is too old, or whose timestamp is more than maxAge before
+// the newest one accepted. Timestamps are only compared with those of the
+// same sender, so peers whose clocks are off still talk.
+type ReplayWindow struct {
+	highest uint64
+	bitmap  uint64
+	newest  int64
+	Reject  int64
+}
+
+func (s *ReplayWindow) Check(header *Header, maxAge time.Duration) error {
+	if header.Version < ReplayVersion {
+		return nil
+	}
+	err := s.check(header, maxAge)
+	if err != nil {
+		s.Reject++
+		return err
+	}
+	if header.Timestamp > s.newest {
+		s.newest = header.Timestamp
+	}
+	return nil
+}
+
+func (s *ReplayWindow) check(header *Header, maxAge time.Duration) error {
+	if s.newest != 0 && header.Timestamp < s.newest-int64(maxAge) {
+		return errors.New("Package timestamp out of range.")
+	}
+	seq := header.Sequence
+	if seq > s.highest {
+		shift := seq - s.highest
+		if shift >= ReplayWindowSize {
+			s.bitmap = 0
+		} else {
+			s.bitmap <<= shift
+		}
+		s.bitmap |= 1
+		s.highest = seq
+		return nil
+	}
+	offset := s.highest - seq
+	if offset >= ReplayWindowSize {
+		return errors.New("Package sequence too old.")
+	}
+	if s.bitmap&(1<<offset) != 0 {
+		return errors.New("Package replayed.")
+	}
+	s.bitmap |= 1 << offset
+	return nil
+}
@@ -0,0 +1,51 @@
+package udp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplayWindow(t *testing.T) {
+	w := &ReplayWindow{}
+	now := time.Now().UnixNano()
+	header := func(seq uint64) *Header {
+		return &Header{Version: ReplayVersion, Sequence: seq, Timestamp: now}
+	}
+	for _, seq := range []uint64{1000, 1002, 1001, 1064} {
+		if err := w.Check(header(seq), time.Minute); err != nil {
+			t.Fatal("Rejected fresh package.", seq, err)
+		}
+	}
+	for _, seq := range []uint64{1000, 1001, 1064} {
+		if err := w.Check(header(seq), time.Minute); err == nil {
+			t.Fatal("Accepted replayed package.", seq)
+		}
+	}
+	if err := w.Check(header(1003), time.Minute); err != nil {
+		t.Fatal("Rejected reordered package.", err)
+	}
+	old := header(2000)
+	old.Timestamp = now - int64(2*time.Minute)
+	if err := w.Check(old, time.Minute); err == nil {
+		t.Fatal("Accepted old package.")
+	}
+	if w.Reject != 4 {
+		t.Fatal("Error reject count.", w.Reject)
+	}
+	if err := w.Check(&Header{Version: AuthVersion}, time.Minute); err != nil {
+		t.Fatal("Rejected package without sequence.", err)
+	}
+
+	// A sender whose clock is hours off is accepted, as long as its own
+	// timestamps stay fresh.
+	skewed := &ReplayWindow{}
+	then := now - int64(3*time.Hour)
+	for i, seq := range []uint64{1, 2, 3} {
+		if err := skewed.Check(&Header{Version: ReplayVersion, Sequence: seq, Timestamp: then + int64(i)*int64(time.Second)}, time.Minute); err != nil {
+			t.Fatal("Rejected skewed sender.", seq, err)
+		}
+	}
+	if err := skewed.Check(&Header{Version: ReplayVersion, Sequence: 4, Timestamp: then - int64(2*time.Minute)}, time.Minute); err == nil {
+		t.Fatal("Accepted package older than the newest one.")
+	}
+}
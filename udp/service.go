@@ -1,24 +1,50 @@
 package udp
 
 import (
+	"context"
+	"math/rand"
 	"net"
 	"github.com/emirpasic/gods/maps/treemap"
 	"sync"
 	"time"
 	"github.com/Catofes/go-its/config"
 	"github.com/Catofes/go-its/its"
+	"strconv"
 )
 
+// probeWindow is how many echoes per peer loss and latency are computed over,
+// lossTimeout how long a reply may take before it is counted as late.
+var probeWindow = 100
+var lossTimeout = time.Second
+
+// ProbeAnomalies counts replies which were duplicated, arrived after a reply
+// to a later echo, or arrived after the loss timeout or after their echo
+// left the window.
+type ProbeAnomalies struct {
+	Duplicates int64
+	Reordered  int64
+	Late       int64
+}
+
+// ICMPStack keeps the last echoes sent to a peer. Latency is the average
+// round trip over them, Stats has the detailed statistics.
 type ICMPStack struct {
 	data                 treemap.Map
+	window               int
+	highestReplied       int
 	Latency              int64
 	ReceivedPackageCount int64
 	PackageLost          float32
+	Stats                LatencyStats
+	Clock                ClockEstimator
+	Anomalies            ProbeAnomalies
 	mutex                sync.Mutex
 }
 
-func (s *ICMPStack) Init() *ICMPStack {
+func (s *ICMPStack) Init(window int) *ICMPStack {
 	s.data = *treemap.NewWithIntComparator()
+	s.window = window
+	s.Stats.Init(window)
 	return s
 }
 
@@ -36,7 +62,7 @@ func (s *ICMPStack) Get() *EchoPackage {
 	echoPackage.Id = id
 	echoPackage.EchoTimestamp = time.Now().UnixNano()
 	s.data.Put(id, &echoPackage)
-	if s.data.Size() > 100 {
+	if s.data.Size() > s.window {
 		k, v := s.data.Min()
 		p := v.(*EchoPackage)
 		if p.ReplyTimestamp > 0 {
@@ -44,7 +70,9 @@ func (s *ICMPStack) Get() *EchoPackage {
 		}
 		s.data.Remove(k)
 	}
-	s.PackageLost = 1 - float32(s.ReceivedPackageCount)/float32(s.data.Size()-1)
+	if s.data.Size() > 1 {
+		s.PackageLost = 1 - float32(s.ReceivedPackageCount)/float32(s.data.Size()-1)
+	}
 	return &echoPackage
 }
 
@@ -54,18 +82,48 @@ func (s *ICMPStack) Put(reply *EchoPackage) {
 	id := reply.Id
 	v, ok := s.data.Get(id)
 	if !ok {
+		if k, _ := s.data.Min(); k != nil && id < k.(int) {
+			s.Anomalies.Late++
+		}
 		return
 	}
 	request := v.(*EchoPackage)
 	if request.ReplyTimestamp > 0 {
+		s.Anomalies.Duplicates++
 		return
 	}
+	if id < s.highestReplied {
+		s.Anomalies.Reordered++
+	} else {
+		s.highestReplied = id
+	}
+	now := time.Now().UnixNano()
+	request.ReceiveTimestamp = reply.ReceiveTimestamp
 	request.ReplyTimestamp = reply.ReplyTimestamp
-	request.Relay = time.Now().UnixNano() - request.EchoTimestamp
+	s.Clock.Add(request.EchoTimestamp, request.ReceiveTimestamp, request.ReplyTimestamp, now)
+	s.received(request, now-request.EchoTimestamp)
+}
+
+// Record stores the round trip of a probe which was answered without an
+// echo reply, e.g. a tcp connect.
+func (s *ICMPStack) Record(request *EchoPackage, relay time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	request.ReplyTimestamp = request.EchoTimestamp + int64(relay)
+	request.ReceiveTimestamp = request.ReplyTimestamp
+	s.received(request, int64(relay))
+}
 
-	s.Latency = (s.Latency*s.ReceivedPackageCount + request.Relay) / int64(s.ReceivedPackageCount+1)
+func (s *ICMPStack) received(request *EchoPackage, relay int64) {
+	if time.Duration(relay) > lossTimeout {
+		s.Anomalies.Late++
+	}
+	request.Relay = relay
+	s.Stats.Add(request.Relay)
+
+	s.Latency = s.Stats.Avg
 	s.ReceivedPackageCount++
-	if s.data.Size() > 100 {
+	if s.data.Size() > s.window {
 		k, v := s.data.Min()
 		p := v.(*EchoPackage)
 		if p.ReplyTimestamp > 0 {
@@ -79,33 +137,152 @@ func (s *ICMPStack) Put(reply *EchoPackage) {
 type RemoteServer struct {
 	Ip             net.IP
 	Port           uint16
+	Version        byte
+	Capabilities   uint32
+	Identity       uint32
+	negotiated     bool
+	AckedVersion   uint64
+	lastFullSync   time.Time
+	NodeId         NodeId
+	Parameters     Parameters
+	Target         string
+	Center         bool
+	Seed           bool
+	fromCenter     bool
+	web            string
+	Transport      string
+	udpSince       time.Time
+	dialing        bool
+	registered     bool
+	centerState    uint64
+	prober         Prober
+	timeout        time.Duration
+	Name           string
+	Labels         map[string]string
 	LastOnline     time.Time
 	OffLine        bool
 	LinkDown       bool
 	PackageReceive *ICMPStack
+	Replay         *ReplayWindow
 	ServerInfo     map[string]*ServerInfo
+	probes         map[string]*pendingProbe
 }
 
 func (s *RemoteServer) Init(ip net.IP, port uint16) *RemoteServer {
 	s.Ip = ip
 	s.Port = port
+	s.Version = ProtocolVersion
+	s.Capabilities = LocalCapabilities
 	s.LastOnline = time.Time{}
 	s.LinkDown = false
 	s.OffLine = false
-	s.PackageReceive = (&ICMPStack{}).Init()
+	s.Transport = TransportUDP
+	s.udpSince = time.Now()
+	s.PackageReceive = (&ICMPStack{}).Init(probeWindow)
+	s.Replay = &ReplayWindow{}
 	s.ServerInfo = make(map[string]*ServerInfo)
 	return s
 }
 
+// negotiate records the protocol version and capabilities announced by the
+// remote server in header.
+func (s *RemoteServer) negotiate(header *Header) {
+	if s.Version != header.Version || s.Capabilities != Negotiate(header.Capabilities) {
+		log.Info("Server %s uses protocol version %d, capabilities %x.", s.Ip.String(), header.Version, header.Capabilities)
+	}
+	s.Version = header.Version
+	s.Capabilities = Negotiate(header.Capabilities)
+	s.Identity = header.Identity
+	s.negotiated = true
+}
+
+// accept rejects unauthenticated packages from a server which already talked
+// authenticated packages, plain packages describing the peers from a server
+// which agreed to encrypt them, and replayed packages. Until the server
+// announced its version the preset one is only a guess, and any version is
+// accepted.
+func (s *RemoteServer) accept(header *Header, maxAge time.Duration) bool {
+	if s.negotiated && s.Version >= AuthVersion && header.Version < s.Version {
+		log.Warning("Drop downgraded package from %s.", s.Ip.String())
+		return false
+	}
+	if s.negotiated && confidential(header.Type) &&
+		Negotiate(s.Capabilities)&CapabilityEncryption != 0 && !header.Encrypted {
+		log.Warning("Drop unencrypted package from %s.", s.Ip.String())
+		return false
+	}
+	if err := s.Replay.Check(header, maxAge); err != nil {
+		log.Warning("Drop package from %s. %s", s.Ip.String(), err.Error())
+		return false
+	}
+	return true
+}
+
+// describe records the node info a server announced in its sync package.
+func (s *RemoteServer) describe(node *NodeInfo) {
+	if node.Id.IsZero() {
+		return
+	}
+	s.NodeId = node.Id
+	s.Name = node.Name
+	s.Labels = node.Labels
+}
+
+func (s *RemoteServer) acceptAll(headers []*Header, maxAge time.Duration) bool {
+	for _, header := range headers {
+		if !s.accept(header, maxAge) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *RemoteServer) key() string {
+	return nodeKey(s.NodeId, s.Ip, s.Port)
+}
+
+// moveTo follows a server whose address changed.
+func (s *RemoteServer) moveTo(ip net.IP, port uint16) {
+	if s.Ip.Equal(ip) && s.Port == port {
+		return
+	}
+	log.Warning("Server %s moved from %s to %s.", s.key(),
+		net.JoinHostPort(s.Ip.String(), strconv.Itoa(int(s.Port))), net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	s.Ip = ip
+	s.Port = port
+}
+
+func (s *RemoteServer) header(packageType byte) *Header {
+	header := NewHeader(packageType, s.Version, s.Capabilities)
+	header.Identity = s.Identity
+	return header
+}
+
+// MainService tracks the servers it knows by node id, or by address for
+// servers which do not announce one.
 type MainService struct {
 	Servers     map[string]*RemoteServer
 	ip          net.IP
+	node        NodeInfo
 	pingEvery   time.Duration
 	syncEvery   time.Duration
 	offlineTime time.Duration
 	checkEvery  time.Duration
 	deleteEvery time.Duration
-	Mutex       sync.Mutex
+	maxAge      time.Duration
+	reassembler *Reassembler
+	peerState   *PeerState
+	refusals    *RateLimiter
+	election    *Election
+	gossip      bool
+	fanout      int
+	fallback    string
+	fullSync    time.Duration
+	Departed    uint64
+	// Registration is the last answer of a center, on clients.
+	Registration RegisterAck
+	wait         sync.WaitGroup
+	Mutex        sync.Mutex
 }
 
 func (s *MainService) Init() *MainService {
@@ -116,59 +293,284 @@ func (s *MainService) Init() *MainService {
 	s.offlineTime = time.Duration(c.OfflineTime) * time.Millisecond
 	s.checkEvery = time.Duration(c.CheckEvery) * time.Millisecond
 	s.deleteEvery = time.Duration(c.DeleteEvery) * time.Millisecond
-	udpService.AddHandler(byte(1), s.echoReplyHandler)
-	udpService.AddHandler(byte(2), s.syncHandler)
-	if !udpService.isServer {
-		Center := (&RemoteServer{}).Init(net.ParseIP(c.CenterServerAddress), c.CenterServerPort)
-		s.Servers[c.CenterServerAddress] = Center
+	s.maxAge = time.Duration(c.MaxPackageAge) * time.Millisecond
+	probeWindow = int(c.ProbeWindow)
+	lossTimeout = time.Duration(c.LossTimeout) * time.Millisecond
+	s.reassembler = (&Reassembler{}).Init(time.Duration(c.FragmentTimeout) * time.Millisecond)
+	s.peerState = (&PeerState{}).Init()
+	s.refusals = (&RateLimiter{}).Init(RefusalRate, RefusalBurst)
+	s.fullSync = time.Duration(c.FullSyncEvery) * time.Millisecond
+	udpService.Register(PackageTypeEchoReply, DecodeEcho, s.echoReplyHandler)
+	udpService.Register(PackageTypeSync, DecodeSync, s.syncHandler)
+	udpService.Register(PackageTypeGoodbye, DecodeGoodbye, s.goodbyeHandler)
+	udpService.Register(PackageTypeLease, DecodeLease, s.leaseHandler)
+	udpService.Register(PackageTypeLeaseAck, DecodeLease, s.leaseAckHandler)
+	s.gossip = c.Gossip
+	s.fanout = int(c.GossipFanout)
+	s.fallback = c.Fallback
+	if s.fallback != "" && s.fallback != TransportTCP && s.fallback != TransportWebSocket {
+		log.Fatal("Unknown fallback transport: ", s.fallback)
+	}
+	if s.gossip {
+		udpService.Register(PackageTypeGossip, DecodeGossip, s.gossipHandler)
+		udpService.Register(PackageTypeProbeRequest, DecodeProbe, s.probeRequestHandler)
+		udpService.Register(PackageTypeProbeReply, DecodeProbe, s.probeReplyHandler)
+	}
+	if udpService.isServer {
+		udpService.Register(PackageTypeRegister, DecodeRegister, s.registerHandler)
 	} else {
+		udpService.Register(PackageTypeRegisterAck, DecodeRegisterAck, s.registerAckHandler)
+	}
+	id, err := LoadNodeId(c.NodeIdFile)
+	if err != nil {
+		log.Fatal("Can't load node id: ", err)
+	}
+	s.node = NodeInfo{id, c.NodeName, c.Labels}
+	if err := s.node.Validate(); err != nil {
+		log.Fatal("Wrong node info: ", err)
+	}
+	if udpService.isServer {
 		s.ip = net.ParseIP(c.CenterServerAddress)
 	}
+	centers := s.addCenters(c)
+	for _, v := range c.Seeds {
+		if !s.gossip {
+			log.Warning("Seeds are only used with gossip.")
+			break
+		}
+		seed := (&RemoteServer{}).Init(net.ParseIP(v.Address), v.Port)
+		seed.Seed = true
+		if _, known := s.Servers[seed.key()]; !known {
+			s.Servers[seed.key()] = seed
+		}
+	}
+	s.election = (&Election{}).Init(s.node.Id, time.Duration(c.LeaseTime)*time.Millisecond,
+		udpService.isServer, centers, time.Now())
+	for _, target := range c.Targets {
+		s.addTarget(target)
+	}
 	return s
 }
 
-func (s *MainService) Loop() {
-	go s.pingLoop()
-	go s.syncLoop()
-	go s.deleteLoop()
+// addCenters adds the other centers and returns how many there are, this
+// one included. Without Centers a client syncs with CenterServerAddress,
+// while a center is the only one.
+func (s *MainService) addCenters(c *config.MainConfig) int {
+	addresses := c.Centers
+	if len(addresses) == 0 && c.CenterServerAddress != "" && !udpService.isServer {
+		addresses = []config.NodeAddress{{Address: c.CenterServerAddress, Port: c.CenterServerPort}}
+	}
+	centers := 0
+	if udpService.isServer {
+		centers = 1
+	}
+	for _, v := range addresses {
+		ip := net.ParseIP(v.Address)
+		if udpService.isServer && ip.Equal(s.ip) && v.Port == c.ListenPort {
+			continue
+		}
+		center := (&RemoteServer{}).Init(ip, v.Port)
+		center.Identity = c.Identity
+		center.Center = true
+		center.web = v.WebAddress
+		if s.fallback == TransportWebSocket && center.web == "" {
+			log.Warning("No web address of center %s, it can't be reached over websocket.", v.Address)
+		}
+		s.Servers[center.key()] = center
+		centers++
+	}
+	return centers
+}
+
+// addTarget monitors a configured target. Udp targets are probed like the
+// peers, the others by their own probeLoop.
+func (s *MainService) addTarget(target config.ProbeTarget) {
+	prober, err := NewProber(target)
+	if err != nil {
+		log.Warning("Skip target %s: %s", target.Name, err.Error())
+		return
+	}
+	remoteServer := &RemoteServer{}
+	key := "target:" + target.Name
+	if prober == nil {
+		address, err := net.ResolveUDPAddr("udp", target.Address)
+		if err != nil {
+			log.Warning("Skip target %s: %s", target.Name, err.Error())
+			return
+		}
+		remoteServer.Init(address.IP, uint16(address.Port))
+		key = remoteServer.key()
+	} else {
+		remoteServer.Init(nil, 0)
+	}
+	remoteServer.Target = target.Name
+	remoteServer.prober = prober
+	remoteServer.timeout = time.Duration(target.Timeout) * time.Millisecond
+	s.Servers[key] = remoteServer
+}
+
+// Loop starts the loops, they run until ctx is done.
+func (s *MainService) Loop(ctx context.Context) {
+	s.wait.Add(3)
+	go s.pingLoop(ctx)
+	go s.syncLoop(ctx)
+	go s.deleteLoop(ctx)
+	for _, v := range s.Servers {
+		if v.prober != nil {
+			s.wait.Add(1)
+			go s.probeLoop(ctx, v)
+		}
+	}
 	if udpService.isServer {
 		(&its.Manager{}).Init()
 		go (&WebServer{}).Init().Run()
-		go its.ItsManager.Loop()
-		go s.checkLoop()
+		go its.ItsManager.Loop(ctx)
+		go its.ItsManager.SessionLoop(ctx)
+		s.wait.Add(2)
+		go s.checkLoop(ctx)
+		go s.leaseLoop(ctx)
+	} else {
+		s.wait.Add(1)
+		go s.registerLoop(ctx)
+		if s.gossip {
+			s.wait.Add(1)
+			go s.checkLoop(ctx)
+		}
+	}
+	if s.gossip {
+		s.wait.Add(1)
+		go s.gossipLoop(ctx)
+	}
+}
+
+// Stop waits for the loops to end and says goodbye to the servers, so they
+// forget this one at once.
+func (s *MainService) Stop() {
+	s.wait.Wait()
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	goodbye := GoodbyePackage{s.node.Id}
+	for _, v := range s.Servers {
+		if v.prober != nil || v.Target != "" || v.Version < GoodbyeVersion || s.isSelf(v.NodeId, v.Ip) {
+			continue
+		}
+		address := &net.UDPAddr{IP: v.Ip, Port: int(v.Port)}
+		udpService.WriteToUDP(goodbye.ToData(v.header(PackageTypeGoodbye)), address)
 	}
 }
 
-func (s *MainService) pingLoop() {
-	for {
-		time.Sleep(s.pingEvery)
+// interval reads an interval the center may change.
+func (s *MainService) interval(d *time.Duration) time.Duration {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	return *d
+}
+
+// parameters returns the intervals this server uses.
+func (s *MainService) parameters() Parameters {
+	return Parameters{
+		PingEvery:   uint32(s.pingEvery / time.Millisecond),
+		SyncEvery:   uint32(s.syncEvery / time.Millisecond),
+		OfflineTime: uint32(s.offlineTime / time.Millisecond),
+	}
+}
+
+// apply uses the intervals set by the center. Unset ones and ones below
+// MinInterval are ignored.
+func (s *MainService) apply(p Parameters) {
+	current := s.parameters()
+	for _, v := range []struct {
+		value uint32
+		d     *time.Duration
+	}{{p.PingEvery, &s.pingEvery}, {p.SyncEvery, &s.syncEvery}, {p.OfflineTime, &s.offlineTime}} {
+		if v.value >= MinInterval {
+			*v.d = time.Duration(v.value) * time.Millisecond
+		}
+	}
+	if applied := s.parameters(); applied != current {
+		log.Warning("Apply center parameters: ping every %dms, sync every %dms, offline after %dms.",
+			applied.PingEvery, applied.SyncEvery, applied.OfflineTime)
+	}
+}
+
+// ReportedParameters returns the parameters of this server under "self" and
+// the ones each server reported.
+func (s *MainService) ReportedParameters() map[string]Parameters {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	result := map[string]Parameters{"self": s.parameters()}
+	for k, v := range s.Servers {
+		if v.Parameters != (Parameters{}) {
+			result[k] = v.Parameters
+		}
+	}
+	return result
+}
+
+// sleep waits for d, it returns false when ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func (s *MainService) pingLoop(ctx context.Context) {
+	defer s.wait.Done()
+	for sleep(ctx, s.interval(&s.pingEvery)) {
 		s.Mutex.Lock()
 		for _, v := range s.Servers {
-			if v.Ip.Equal(s.ip) {
+			if v.prober != nil || s.isSelf(v.NodeId, v.Ip) {
 				continue
 			}
 			echoPackage := v.PackageReceive.Get()
 			address := &net.UDPAddr{}
 			address.IP = v.Ip
 			address.Port = int(v.Port)
-			udpService.connection.WriteToUDP(echoPackage.ToData(), address)
+			udpService.WriteToUDP(echoPackage.ToData(v.header(PackageTypeEchoRequest)), address)
+		}
+		s.Mutex.Unlock()
+	}
+}
+
+// probeLoop probes a target which doesn't answer echo packages. A
+// successful probe counts like an echo reply.
+func (s *MainService) probeLoop(ctx context.Context, target *RemoteServer) {
+	defer s.wait.Done()
+	for sleep(ctx, s.interval(&s.pingEvery)) {
+		echoPackage := target.PackageReceive.Get()
+		start := time.Now()
+		if err := target.prober.Probe(target.timeout); err != nil {
+			log.Debug("Probe %s failed: %s", target.Target, err.Error())
+			continue
 		}
+		target.PackageReceive.Record(echoPackage, time.Since(start))
+		s.Mutex.Lock()
+		target.LastOnline = time.Now()
 		s.Mutex.Unlock()
 	}
 }
 
-func (s *MainService) syncLoop() {
-	for {
-		time.Sleep(s.syncEvery)
+func (s *MainService) syncLoop(ctx context.Context) {
+	defer s.wait.Done()
+	for sleep(ctx, s.interval(&s.syncEvery)) {
 		s.Mutex.Lock()
 		if udpService.isServer {
+			s.updatePeerState()
 			for _, v := range s.Servers {
-				s.syncTo(v)
+				if v.prober == nil && v.Target == "" {
+					s.syncTo(v)
+				}
 			}
 		} else {
-			v, ok := s.Servers[config.GetInstance("").CenterServerAddress]
-			if ok {
-				s.syncTo(v)
+			for _, v := range s.Servers {
+				if v.Center {
+					s.syncTo(v)
+				}
 			}
 		}
 		for _, v := range s.Servers {
@@ -184,14 +586,17 @@ func (s *MainService) syncLoop() {
 	}
 }
 
-func (s *MainService) checkLoop() {
-	for {
-		time.Sleep(s.checkEvery)
+// checkLoop judges which servers are offline and which links are down, from
+// its own probes and what the other servers report. Only centers do this,
+// unless gossip spreads the reports to every server.
+func (s *MainService) checkLoop(ctx context.Context) {
+	defer s.wait.Done()
+	for sleep(ctx, s.checkEvery) {
 		s.Mutex.Lock()
 		linkDown := 0
 		offLine := 0
 		checkResult := false
-		for _, v := range s.Servers {
+		for k, v := range s.Servers {
 			if v.LastOnline.Equal(time.Time{}) {
 				continue
 			}
@@ -200,20 +605,20 @@ func (s *MainService) checkLoop() {
 				timeoutCount := 0
 				totalServer := 0
 				for _, u := range s.Servers {
-					if u.Ip.Equal(v.Ip) {
+					if u == v {
 						continue
 					}
-					remoteServer, ok := u.ServerInfo[v.Ip.String()]
+					remoteServer, ok := u.ServerInfo[k]
 					if ok {
-						t_ := remoteServer.LastOnline
-						t := time.Unix(int64(t_)/1e9, int64(t_)%1e9)
+						t := u.PackageReceive.Clock.LocalTime(int64(remoteServer.LastOnline))
 						if t.Add(s.offlineTime).Before(time.Now()) {
 							timeoutCount++
 						}
 						totalServer++
 					}
 				}
-				if float64(timeoutCount)/float64(totalServer) > 0.6 {
+				// Targets nobody else reports, like external services, count as link down.
+				if totalServer > 0 && float64(timeoutCount)/float64(totalServer) > 0.6 {
 					v.OffLine = true
 					offLine++
 				} else {
@@ -233,21 +638,24 @@ func (s *MainService) checkLoop() {
 			log.Warning("%d/%d Link Down!", linkDown, len(s.Servers))
 			checkResult = true
 		}
-		if checkResult {
-			its.ItsManager.LinkDown()
-		} else {
-			its.ItsManager.LinkUp()
+		// Only the leader drives the gateway.
+		if s.election.IsLeader(time.Now()) {
+			if checkResult {
+				its.ItsManager.LinkDown()
+			} else {
+				its.ItsManager.LinkUp()
+			}
 		}
 		s.Mutex.Unlock()
 	}
 }
 
-func (s *MainService) deleteLoop() {
-	for {
-		time.Sleep(100 * s.checkEvery)
+func (s *MainService) deleteLoop(ctx context.Context) {
+	defer s.wait.Done()
+	for sleep(ctx, 100*s.checkEvery) {
 		s.Mutex.Lock()
 		for k, v := range s.Servers {
-			if v.LastOnline.Add(s.deleteEvery).Before(time.Now()) {
+			if v.Target == "" && !v.Center && !v.Seed && v.LastOnline.Add(s.deleteEvery).Before(time.Now()) {
 				log.Warning("Delete server %s.", )
 				delete(s.Servers, k)
 			}
@@ -256,94 +664,761 @@ func (s *MainService) deleteLoop() {
 	}
 }
 
+// ReplayRejected returns how many packages were rejected by the replay
+// window of each server.
+func (s *MainService) ReplayRejected() map[string]int64 {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	result := make(map[string]int64)
+	for k, v := range s.Servers {
+		result[k] = v.Replay.Reject
+	}
+	return result
+}
+
+func (s *MainService) findByAddress(ip net.IP, port uint16) (string, *RemoteServer) {
+	for k, v := range s.Servers {
+		if v.Ip.Equal(ip) && v.Port == port {
+			return k, v
+		}
+	}
+	return "", nil
+}
+
+// findCenter finds the configured center at ip and port. Clients may also
+// know it from the peer list, under another key until it synced.
+func (s *MainService) findCenter(ip net.IP, port uint16) (string, *RemoteServer) {
+	for k, v := range s.Servers {
+		if v.Center && v.Ip.Equal(ip) && v.Port == port {
+			return k, v
+		}
+	}
+	return "", nil
+}
+
+// isSelf compares node ids, or addresses when the node id is unknown.
+func (s *MainService) isSelf(id NodeId, ip net.IP) bool {
+	if !id.IsZero() {
+		return id == s.node.Id
+	}
+	return ip.Equal(s.ip)
+}
+
+// ProbeAnomalies returns the reply anomalies seen for each server.
+func (s *MainService) ProbeAnomalies() map[string]ProbeAnomalies {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	result := make(map[string]ProbeAnomalies)
+	for k, v := range s.Servers {
+		v.PackageReceive.mutex.Lock()
+		result[k] = v.PackageReceive.Anomalies
+		v.PackageReceive.mutex.Unlock()
+	}
+	return result
+}
+
+// Leadership describes the election of the centers.
+func (s *MainService) Leadership() map[string]interface{} {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	return map[string]interface{}{
+		"term":      s.election.Term,
+		"leader":    s.election.Leader,
+		"until":     s.election.Until.Format("2006-01-02 15:04:05.999999999 -0700 MST"),
+		"is_leader": s.election.IsLeader(time.Now()),
+	}
+}
+
+// DepartedCount returns how many servers said goodbye.
+func (s *MainService) DepartedCount() uint64 {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	return s.Departed
+}
+
+// RemoveIdentity forgets the servers using a revoked identity at once.
+func (s *MainService) RemoveIdentity(identity uint32) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	for k, v := range s.Servers {
+		if v.Identity == identity {
+			log.Warning("Delete server %s with revoked identity %d.", k, identity)
+			delete(s.Servers, k)
+		}
+	}
+}
+
+func (s *RemoteServer) info() *ServerInfo {
+	return &ServerInfo{
+		Ip:           s.Ip,
+		Port:         s.Port,
+		Latency:      uint64(s.PackageReceive.Latency),
+		PackageLost:  s.PackageReceive.PackageLost,
+		LastOnline:   uint64(s.LastOnline.UnixNano()),
+		Version:      s.Version,
+		Capabilities: s.Capabilities,
+		NodeId:       s.NodeId}
+}
+
+// updatePeerState versions the servers the center announces, and forgets
+// removals all clients already acknowledged.
+func (s *MainService) updatePeerState() {
+	current := make(map[string]*ServerInfo)
+	acked := s.peerState.Version
+	for k, v := range s.Servers {
+		// Targets are no peers, they neither get nor acknowledge syncs.
+		if v.prober != nil || v.Target != "" {
+			continue
+		}
+		if !v.OffLine && v.Transport == TransportUDP {
+			current[k] = v.info()
+		}
+		if v.Version >= DeltaVersion && v.AckedVersion < acked {
+			acked = v.AckedVersion
+		}
+	}
+	s.peerState.Update(current)
+	s.peerState.Prune(acked)
+}
+
 func (s *MainService) syncTo(remoteServer *RemoteServer) {
 	p := (&SyncPackage{}).Init()
 	p.Self.Ip = remoteServer.Ip
 	p.Self.Port = remoteServer.Port
 	p.Token = config.GetInstance("").Token
-	for _, v := range s.Servers {
-		if v.OffLine {
-			continue
+	p.Node = s.node
+	p.Parameters = s.parameters()
+	full := true
+	if !udpService.isServer {
+		p.BaseVersion = remoteServer.centerState
+	} else {
+		p.StateVersion = s.peerState.Version
+		if remoteServer.Version >= DeltaVersion && s.peerState.CanDelta(remoteServer.AckedVersion) &&
+			time.Since(remoteServer.lastFullSync) < s.fullSync {
+			full = false
+			p.BaseVersion = remoteServer.AckedVersion
+			for _, v := range s.peerState.Delta(remoteServer.AckedVersion) {
+				p.Servers.Push(v)
+			}
+		} else {
+			remoteServer.lastFullSync = time.Now()
+		}
+	}
+	if full {
+		for _, v := range s.Servers {
+			// Servers on streams can't be reached by the others.
+			if v.OffLine || v.prober != nil || v.Target != "" || v.Transport != TransportUDP {
+				continue
+			}
+			p.Servers.Push(v.info())
 		}
-		p.Servers.Push(&ServerInfo{v.Ip, v.Port,
-								   uint64(v.PackageReceive.Latency),
-								   v.PackageReceive.PackageLost,
-								   uint64(v.LastOnline.UnixNano())})
 	}
-	d, n := p.ToData()
+	d, n := p.ToData(remoteServer.header(PackageTypeSync))
 	address := &net.UDPAddr{}
 	address.IP = remoteServer.Ip
 	address.Port = int(remoteServer.Port)
 	for i := 0; i < n; i++ {
-		udpService.connection.WriteToUDP(d[i], address)
+		udpService.WriteToUDP(d[i], address)
 	}
 }
 
-func (s *MainService) echoReplyHandler(conn *net.UDPConn, addr *net.UDPAddr, n int, data []byte) {
+func (s *MainService) echoReplyHandler(r *Request) {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
-	if n != EchoPackageLength {
-		log.Info("Wrong package size at package type 1.")
+	addr, header := r.Address, r.Header
+	_, v := s.findByAddress(addr.IP, uint16(addr.Port))
+	if v == nil {
+		return
 	}
-	v, ok := s.Servers[addr.IP.String()]
-	if !ok {
+	if !v.accept(header, s.maxAge) {
 		return
 	}
-	replyPackage := EchoPackage{}
-	replyPackage.LoadFromData(data)
-	v.PackageReceive.Put(&replyPackage)
+	v.negotiate(header)
+	v.PackageReceive.Put(r.Message.(*EchoPackage))
 	v.LastOnline = time.Now()
+	s.answerProbes(v, v.LastOnline)
+}
+
+// admit finds the server at addr announcing node, or adds it, once its
+// packages passed the checks. alreadyIn tells if it was known before.
+func (s *MainService) admit(node *NodeInfo, addr *net.UDPAddr, headers []*Header) (string, *RemoteServer, bool) {
+	key := nodeKey(node.Id, addr.IP, uint16(addr.Port))
+	remoteServer, alreadyIn := s.Servers[key]
+	oldKey := ""
+	if !alreadyIn {
+		// A server announcing its node id for the first time.
+		if k, v := s.findByAddress(addr.IP, uint16(addr.Port)); v != nil && v.NodeId.IsZero() {
+			oldKey, remoteServer, alreadyIn = k, v, true
+		} else {
+			remoteServer = (&RemoteServer{}).Init(addr.IP, uint16(addr.Port))
+		}
+	}
+	if !remoteServer.acceptAll(headers, s.maxAge) {
+		return key, nil, alreadyIn
+	}
+	if oldKey != "" {
+		delete(s.Servers, oldKey)
+	}
+	remoteServer.negotiate(headers[len(headers)-1])
+	remoteServer.moveTo(addr.IP, uint16(addr.Port))
+	remoteServer.describe(node)
+	remoteServer.Transport = udpService.Transport(addr)
+	s.Servers[key] = remoteServer
+	return key, remoteServer, alreadyIn
+}
+
+// registerHandler admits a client at once and answers with the parameters
+// of the center, or why the client was refused. Refusals are signed with
+// the shared key, the client may not be able to verify them. Since anyone
+// can trigger them with a spoofed source, they are rate limited per source.
+func (s *MainService) registerHandler(r *Request) {
+	addr, header := r.Address, r.Header
+	ack := RegisterAck{Code: registerCode(header.AuthError)}
+	if ack.Code == RegisterOK && udpService.RequireIdentity && header.Identity == 0 {
+		ack.Code = RegisterIdentityRequired
+	}
+	if ack.Code != RegisterOK && !s.refusals.Allow(addr.IP, time.Now()) {
+		countDrop(&drops.RateLimited)
+		return
+	}
+	replyHeader := NewHeader(PackageTypeRegisterAck, header.Version, header.Capabilities)
+	if ack.Code == RegisterOK {
+		s.Mutex.Lock()
+		key, remoteServer, alreadyIn := s.admit(&r.Message.(*RegisterPackage).Node, addr, []*Header{header})
+		s.Mutex.Unlock()
+		if remoteServer == nil {
+			return
+		}
+		if !alreadyIn {
+			log.Warning("Server %s registered with identity %d.", key, header.Identity)
+		}
+		ack.Identity = header.Identity
+		ack.Ip = addr.IP
+		ack.Port = uint16(addr.Port)
+		ack.PingEvery = uint32(s.pingEvery / time.Millisecond)
+		ack.SyncEvery = uint32(s.syncEvery / time.Millisecond)
+		ack.OfflineTime = uint32(s.offlineTime / time.Millisecond)
+		replyHeader.Identity = header.Identity
+	} else {
+		log.Warning("Refuse registration from %s: %s.", addr.String(), RegisterReason(ack.Code))
+	}
+	data := ack.ToData(replyHeader)
+	if data == nil {
+		return
+	}
+	if _, err := r.Connection.WriteToUDP(data, addr); err != nil {
+		log.Info("Write package to %s wrong.", addr.String())
+	}
 }
 
-func (s *MainService) syncHandler(conn *net.UDPConn, addr *net.UDPAddr, n int, data []byte) {
+// registerAckHandler applies the answer of the center. Refusals are logged
+// even when they don't authenticate, since a client with a wrong key can't
+// verify them, but only authenticated answers change the registration.
+func (s *MainService) registerAckHandler(r *Request) {
 	s.Mutex.Lock()
 	defer s.Mutex.Unlock()
-	replyPackage := (&SyncPackage{}).Init()
-	err := replyPackage.LoadFromData(data, n)
-	if err != nil {
+	addr, header := r.Address, r.Header
+	_, center := s.findCenter(addr.IP, uint16(addr.Port))
+	if center == nil {
+		countDrop(&drops.UnknownPeer)
+		return
+	}
+	ack := r.Message.(*RegisterAck)
+	if ack.Code != RegisterOK && !header.Authenticated {
+		log.Error("Center %s may have refused registration: %s.", center.Ip.String(), RegisterReason(ack.Code))
+		return
+	}
+	if !header.Authenticated || !center.accept(header, s.maxAge) {
+		return
+	}
+	center.negotiate(header)
+	if ack.Code != RegisterOK {
+		if s.Registration.Code != ack.Code {
+			log.Error("Center refused registration: %s.", RegisterReason(ack.Code))
+		}
+		s.Registration = RegisterAck{Code: ack.Code}
+		center.registered = false
+		return
+	}
+	if !center.registered {
+		log.Warning("Registered at center %s as %s:%d with identity %d, ping every %dms, sync every %dms, offline after %dms.",
+			center.Ip.String(), ack.Ip.String(), ack.Port, ack.Identity, ack.PingEvery, ack.SyncEvery, ack.OfflineTime)
+	}
+	s.Registration = *ack
+	center.registered = true
+	if s.election.Trusts(center.NodeId, time.Now()) {
+		s.apply(Parameters{ack.PingEvery, ack.SyncEvery, ack.OfflineTime})
+	}
+	s.ip = ack.Ip
+}
+
+// registerLoop registers at each center until it answered, and again when
+// the center went silent, e.g. because it revoked the identity of this
+// client. Centers before RegisterVersion only learn about clients from
+// their syncs.
+func (s *MainService) registerLoop(ctx context.Context) {
+	defer s.wait.Done()
+	for sleep(ctx, s.interval(&s.syncEvery)) {
+		s.Mutex.Lock()
+		for _, center := range s.Servers {
+			if !center.Center {
+				continue
+			}
+			address := &net.UDPAddr{IP: center.Ip, Port: int(center.Port)}
+			s.fallBack(center, address)
+			silent := center.LastOnline.Add(s.offlineTime).Before(time.Now())
+			if center.Version >= RegisterVersion && (!center.registered || silent) {
+				data := (&RegisterPackage{s.node}).ToData(center.header(PackageTypeRegister))
+				udpService.WriteToUDP(data, address)
+			}
+		}
+		s.Mutex.Unlock()
+	}
+}
+
+// fallBack connects a stream to a center which stayed silent over udp for
+// offlineTime, and returns to udp once the stream closed. Connecting doesn't
+// hold the lock, it may take StreamTimeout.
+func (s *MainService) fallBack(center *RemoteServer, address *net.UDPAddr) {
+	if center.Transport != TransportUDP && udpService.Transport(address) == TransportUDP {
+		log.Warning("Stream to center %s closed, retry udp.", address.String())
+		center.Transport = TransportUDP
+		center.udpSince = time.Now()
+		return
+	}
+	if s.fallback == "" || center.dialing || center.Transport != TransportUDP ||
+		time.Since(center.udpSince) < s.offlineTime || center.LastOnline.Add(s.offlineTime).After(time.Now()) {
+		return
+	}
+	center.dialing = true
+	transport, web := s.fallback, center.web
+	go func() {
+		err := udpService.Dial(address, transport, web)
+		s.Mutex.Lock()
+		defer s.Mutex.Unlock()
+		center.dialing = false
+		if err != nil {
+			log.Info("Can't connect stream to center %s. %s", address.String(), err.Error())
+			center.udpSince = time.Now()
+			return
+		}
+		log.Warning("Center %s unreachable over udp, fall back to %s.", address.String(), transport)
+		center.Transport = transport
+	}()
+}
+
+// Transports returns the transport of each server.
+func (s *MainService) Transports() map[string]string {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	result := make(map[string]string)
+	for k, v := range s.Servers {
+		if v.prober == nil {
+			result[k] = v.Transport
+		}
+	}
+	return result
+}
+
+// goodbyeHandler forgets a server which shuts down. Unlike a timeout this is
+// no failure, so checkLoop never sees it. Centers are kept, the others wait
+// for them to come back, but a leaving leader gives up its lease.
+func (s *MainService) goodbyeHandler(r *Request) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	addr, header := r.Address, r.Header
+	if !header.Authenticated {
+		countDrop(&drops.Unauthenticated)
+		return
+	}
+	goodbye := r.Message.(*GoodbyePackage)
+	key := nodeKey(goodbye.Node, addr.IP, uint16(addr.Port))
+	v, ok := s.Servers[key]
+	// Only a server itself may say goodbye.
+	if !ok || v.Target != "" || !v.Ip.Equal(addr.IP) || v.Port != uint16(addr.Port) {
+		countDrop(&drops.UnknownPeer)
+		return
+	}
+	if !v.accept(header, s.maxAge) {
+		return
+	}
+	if v.Center {
+		log.Warning("Center server %s shuts down.", key)
+		s.election.Resign(v.NodeId, time.Now())
+		return
+	}
+	log.Warning("Server %s shuts down.", key)
+	delete(s.Servers, key)
+	s.Departed++
+}
+
+// gossipPeers picks up to n random peers which gossip, except except.
+func (s *MainService) gossipPeers(n int, except *RemoteServer) []*RemoteServer {
+	var peers []*RemoteServer
+	for _, v := range s.Servers {
+		if v == except || v.prober != nil || v.Target != "" || v.Version < GossipVersion || s.isSelf(v.NodeId, v.Ip) {
+			continue
+		}
+		peers = append(peers, v)
+	}
+	rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+	if len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// gossipTo sends the peers this server knows and its view of them.
+func (s *MainService) gossipTo(remoteServer *RemoteServer) {
+	p := (&SyncPackage{}).Init()
+	p.Self.Ip = remoteServer.Ip
+	p.Self.Port = remoteServer.Port
+	p.Token = config.GetInstance("").Token
+	p.Node = s.node
+	for _, v := range s.Servers {
+		if v.OffLine || v.prober != nil || v.Target != "" || v.Transport != TransportUDP {
+			continue
+		}
+		p.Servers.Push(v.info())
+	}
+	d, n := p.ToData(remoteServer.header(PackageTypeGossip))
+	address := &net.UDPAddr{IP: remoteServer.Ip, Port: int(remoteServer.Port)}
+	for i := 0; i < n; i++ {
+		udpService.WriteToUDP(d[i], address)
+	}
+}
+
+// gossipLoop gossips to a few random peers, and asks a few others to probe
+// the peers which went silent, like SWIM. Their replies count in checkLoop
+// like the reports the center collects.
+func (s *MainService) gossipLoop(ctx context.Context) {
+	defer s.wait.Done()
+	for sleep(ctx, s.interval(&s.syncEvery)) {
+		s.Mutex.Lock()
+		for _, v := range s.gossipPeers(s.fanout, nil) {
+			s.gossipTo(v)
+		}
+		for _, v := range s.Servers {
+			if v.prober != nil || v.Target != "" || v.LastOnline.IsZero() ||
+				v.LastOnline.Add(s.offlineTime).After(time.Now()) {
+				continue
+			}
+			request := ProbePackage{*v.info()}
+			for _, u := range s.gossipPeers(s.fanout, v) {
+				address := &net.UDPAddr{IP: u.Ip, Port: int(u.Port)}
+				udpService.WriteToUDP(request.ToData(u.header(PackageTypeProbeRequest)), address)
+			}
+		}
+		s.Mutex.Unlock()
+	}
+}
+
+// gossipHandler admits the sender, adds the peers it knows and records its
+// view of them. Gossip never removes servers, they time out or say goodbye.
+func (s *MainService) gossipHandler(r *Request) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	addr, header := r.Address, r.Header
+	if !header.Authenticated {
+		countDrop(&drops.Unauthenticated)
+		return
+	}
+	p := r.Message.(*SyncPackage)
+	p, headers := s.reassembler.Add(nodeKey(p.Node.Id, addr.IP, uint16(addr.Port)), header, p)
+	if p == nil {
+		return
+	}
+	key, sender, _ := s.admit(&p.Node, addr, headers)
+	if sender == nil {
 		return
 	}
-	if replyPackage.Token != config.GetInstance("").Token {
+	if !udpService.isServer && p.Self.Ip != nil {
+		s.ip = p.Self.Ip
+	}
+	for _, v := range p.Servers.Values() {
+		serverInfo := v.(*ServerInfo)
+		serverKey := nodeKey(serverInfo.NodeId, serverInfo.Ip, serverInfo.Port)
+		if serverKey == key || s.isSelf(serverInfo.NodeId, serverInfo.Ip) {
+			continue
+		}
+		sender.ServerInfo[serverKey] = serverInfo
+		if _, alreadyIn := s.Servers[serverKey]; alreadyIn || serverInfo.Removed {
+			continue
+		}
+		log.Warning("Add gossiped server %s", serverKey)
+		remoteServer := (&RemoteServer{}).Init(serverInfo.Ip, serverInfo.Port)
+		remoteServer.Version = serverInfo.Version
+		remoteServer.Capabilities = Negotiate(serverInfo.Capabilities)
+		remoteServer.negotiated = true
+		remoteServer.NodeId = serverInfo.NodeId
+		s.Servers[serverKey] = remoteServer
+	}
+}
+
+// probeRequestHandler pings the target at once, and answers with the view
+// of this server on it when the target replies within lossTimeout. Targets
+// which don't reply, and unknown ones, aren't answered.
+func (s *MainService) probeRequestHandler(r *Request) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	addr, header := r.Address, r.Header
+	_, requester := s.findByAddress(addr.IP, uint16(addr.Port))
+	if requester == nil || !header.Authenticated {
+		countDrop(&drops.UnknownPeer)
+		return
+	}
+	if !requester.accept(header, s.maxAge) {
+		return
+	}
+	target := &r.Message.(*ProbePackage).Target
+	v, ok := s.Servers[nodeKey(target.NodeId, target.Ip, target.Port)]
+	if !ok || v.prober != nil || v == requester {
+		return
+	}
+	now := time.Now()
+	if v.probes == nil {
+		v.probes = make(map[string]*pendingProbe)
+	}
+	for k, p := range v.probes {
+		if now.Sub(p.since) >= lossTimeout {
+			delete(v.probes, k)
+		}
+	}
+	if len(v.probes) >= MaxPendingProbes {
+		return
+	}
+	v.probes[addr.String()] = &pendingProbe{r.Connection, addr, requester, now}
+	address := &net.UDPAddr{IP: v.Ip, Port: int(v.Port)}
+	r.Connection.WriteToUDP(v.PackageReceive.Get().ToData(v.header(PackageTypeEchoRequest)), address)
+}
+
+// answerProbes sends the view on v to the peers which asked to probe it in
+// time, once v replied.
+func (s *MainService) answerProbes(v *RemoteServer, now time.Time) {
+	if len(v.probes) == 0 {
+		return
+	}
+	reply := ProbePackage{*v.info()}
+	for _, p := range v.probes {
+		if now.Sub(p.since) >= lossTimeout {
+			continue
+		}
+		if data := reply.ToData(p.requester.header(PackageTypeProbeReply)); data != nil {
+			p.connection.WriteToUDP(data, p.address)
+		}
+	}
+	v.probes = nil
+}
+
+// probeReplyHandler records the view of a peer on the target of a probe
+// request.
+func (s *MainService) probeReplyHandler(r *Request) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	addr, header := r.Address, r.Header
+	key, sender := s.findByAddress(addr.IP, uint16(addr.Port))
+	if sender == nil || !header.Authenticated {
+		countDrop(&drops.UnknownPeer)
+		return
+	}
+	if !sender.accept(header, s.maxAge) {
+		return
+	}
+	target := r.Message.(*ProbePackage).Target
+	targetKey := nodeKey(target.NodeId, target.Ip, target.Port)
+	if targetKey == key {
+		return
+	}
+	sender.ServerInfo[targetKey] = &target
+}
+
+// leaseHandler follows the leader a center announces. A center only
+// announces its own lease.
+func (s *MainService) leaseHandler(r *Request) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	addr, header := r.Address, r.Header
+	if !header.Authenticated {
+		countDrop(&drops.Unauthenticated)
+		return
+	}
+	lease := r.Message.(*LeasePackage)
+	_, center := s.findCenter(addr.IP, uint16(addr.Port))
+	if center == nil || center.NodeId != lease.Leader {
+		countDrop(&drops.UnknownPeer)
+		return
+	}
+	if !center.accept(header, s.maxAge) {
+		return
+	}
+	center.negotiate(header)
+	if s.election.Observe(lease, time.Now()) && udpService.isServer {
+		udpService.WriteToUDP(lease.ToData(center.header(PackageTypeLeaseAck)), addr)
+	}
+	s.lead()
+}
+
+// leaseAckHandler counts the centers which acknowledged the lease of this
+// center.
+func (s *MainService) leaseAckHandler(r *Request) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	addr, header := r.Address, r.Header
+	if !header.Authenticated {
+		countDrop(&drops.Unauthenticated)
+		return
+	}
+	lease := r.Message.(*LeasePackage)
+	_, center := s.findCenter(addr.IP, uint16(addr.Port))
+	if center == nil || center.NodeId.IsZero() || lease.Leader != s.node.Id {
+		countDrop(&drops.UnknownPeer)
+		return
+	}
+	if !center.accept(header, s.maxAge) {
+		return
+	}
+	s.election.Ack(center.NodeId, lease.Term, time.Now())
+	s.lead()
+}
+
+// leaseLoop renews the lease while this center leads, or takes over an
+// expired one, and announces it to the other centers. Clients only learn of
+// it once a majority of the centers acknowledged it.
+func (s *MainService) leaseLoop(ctx context.Context) {
+	defer s.wait.Done()
+	for sleep(ctx, s.interval(&s.syncEvery)) {
+		s.Mutex.Lock()
+		now := time.Now()
+		if lease := s.election.Tick(now); lease != nil {
+			quorum := s.election.IsLeader(now)
+			for _, v := range s.Servers {
+				if v.prober != nil || v.Target != "" || v.Version < LeaseVersion || s.isSelf(v.NodeId, v.Ip) || !v.Center && !quorum {
+					continue
+				}
+				address := &net.UDPAddr{IP: v.Ip, Port: int(v.Port)}
+				udpService.WriteToUDP(lease.ToData(v.header(PackageTypeLease)), address)
+			}
+		}
+		s.lead()
+		s.Mutex.Unlock()
+	}
+}
+
+// lead lets the gateway manager of a center follow its leadership.
+func (s *MainService) lead() {
+	if udpService.isServer && its.ItsManager != nil {
+		its.ItsManager.SetActive(s.election.IsLeader(time.Now()))
+	}
+}
+
+func (s *MainService) syncHandler(r *Request) {
+	s.Mutex.Lock()
+	defer s.Mutex.Unlock()
+	addr, header := r.Address, r.Header
+	replyPackage := r.Message.(*SyncPackage)
+	if !header.Authenticated && replyPackage.Token != config.GetInstance("").Token {
 		log.Debug("Receive wrong token package.")
+		countDrop(&drops.Unauthenticated)
+		return
+	}
+	replyPackage, headers := s.reassembler.Add(nodeKey(replyPackage.Node.Id, addr.IP, uint16(addr.Port)), header, replyPackage)
+	if replyPackage == nil {
 		return
 	}
 	if udpService.isServer {
-		remoteServer, alreadyIn := s.Servers[addr.IP.String()]
+		key, remoteServer, alreadyIn := s.admit(&replyPackage.Node, addr, headers)
+		if remoteServer == nil {
+			return
+		}
 		if alreadyIn {
+			remoteServer.AckedVersion = replyPackage.BaseVersion
+			remoteServer.Parameters = replyPackage.Parameters
 			for {
 				v, ok := replyPackage.Servers.Pop()
 				if ! ok {
 					break
 				}
 				serverInfo := v.(*ServerInfo)
-				if remoteServer.Ip.Equal(serverInfo.Ip) {
+				serverKey := nodeKey(serverInfo.NodeId, serverInfo.Ip, serverInfo.Port)
+				if serverKey == key {
 					continue
 				}
-				remoteServer.ServerInfo[serverInfo.Ip.String()] = serverInfo
+				remoteServer.ServerInfo[serverKey] = serverInfo
 			}
-		} else {
-			s.Servers[addr.IP.String()] = (&RemoteServer{}).Init(addr.IP, uint16(addr.Port))
 		}
 
 	} else {
+		centerKey, center := s.findCenter(addr.IP, uint16(addr.Port))
+		if center == nil {
+			countDrop(&drops.UnknownPeer)
+			return
+		}
+		if !center.acceptAll(headers, s.maxAge) {
+			return
+		}
 		if !s.ip.Equal(replyPackage.Self.Ip) {
 			s.ip = replyPackage.Self.Ip
 		}
+		center.negotiate(headers[len(headers)-1])
+		center.describe(&replyPackage.Node)
+		delete(s.Servers, centerKey)
+		s.Servers[center.key()] = center
+		// Every center adds servers, but only the leader removes them and
+		// sets the parameters.
+		authoritative := s.election.Trusts(center.NodeId, time.Now())
+		if authoritative {
+			s.apply(replyPackage.Parameters)
+		}
+		delta := header.Version >= DeltaVersion
+		if delta && replyPackage.BaseVersion != 0 && replyPackage.BaseVersion != center.centerState {
+			log.Debug("Ignore sync delta since %d, holding %d.", replyPackage.BaseVersion, center.centerState)
+			return
+		}
+		listed := make(map[string]bool)
 		for {
 			v, ok := replyPackage.Servers.Pop()
 			if ! ok {
 				break
 			}
 			serverInfo := v.(*ServerInfo)
-			if s.ip.Equal(serverInfo.Ip) {
+			if s.isSelf(serverInfo.NodeId, serverInfo.Ip) {
+				continue
+			}
+			serverKey := nodeKey(serverInfo.NodeId, serverInfo.Ip, serverInfo.Port)
+			listed[serverKey] = true
+			remoteServer, alreadyIn := s.Servers[serverKey]
+			if serverInfo.Removed {
+				if alreadyIn && authoritative && !remoteServer.Center {
+					log.Warning("Remove remote server %s", serverKey)
+					delete(s.Servers, serverKey)
+				}
 				continue
 			}
-			_, alreadyIn := s.Servers[serverInfo.Ip.String()]
 			if !alreadyIn {
-				log.Warning("Add reomte server %s", serverInfo.Ip.String())
-				s.Servers[serverInfo.Ip.String()] = (&RemoteServer{}).Init(serverInfo.Ip, serverInfo.Port)
+				log.Warning("Add reomte server %s", serverKey)
+				remoteServer := (&RemoteServer{}).Init(serverInfo.Ip, serverInfo.Port)
+				remoteServer.Version = serverInfo.Version
+				remoteServer.Capabilities = Negotiate(serverInfo.Capabilities)
+				remoteServer.negotiated = true
+				remoteServer.NodeId = serverInfo.NodeId
+				remoteServer.fromCenter = true
+				s.Servers[serverKey] = remoteServer
+			} else {
+				remoteServer.moveTo(serverInfo.Ip, serverInfo.Port)
 			}
-
+		}
+		// A full sync removes the servers a center announced which it no
+		// longer lists, seeds and gossiped servers stay.
+		if delta && replyPackage.BaseVersion == 0 && authoritative {
+			for k, v := range s.Servers {
+				if !listed[k] && v.fromCenter {
+					log.Warning("Remove remote server %s", k)
+					delete(s.Servers, k)
+				}
+			}
+		}
+		if delta {
+			center.centerState = replyPackage.StateVersion
 		}
 	}
 }
@@ -0,0 +1,34 @@
+package udp
+
+import (
+	"testing"
+	"time"
+)
+
+func TestICMPStackAnomalies(t *testing.T) {
+	s := (&ICMPStack{}).Init(4)
+	echoes := make([]*EchoPackage, 6)
+	for i := range echoes {
+		echoes[i] = s.Get()
+	}
+	reply := func(e *EchoPackage) {
+		r := *e
+		r.ReceiveTimestamp = time.Now().UnixNano()
+		r.ReplyTimestamp = r.ReceiveTimestamp
+		s.Put(&r)
+	}
+	reply(echoes[4])
+	reply(echoes[3])
+	reply(echoes[4])
+	reply(echoes[0])
+	if s.Anomalies.Reordered != 1 || s.Anomalies.Duplicates != 1 || s.Anomalies.Late != 1 {
+		t.Fatal("Error anomalies.", s.Anomalies)
+	}
+	old := lossTimeout
+	lossTimeout = 0
+	defer func() { lossTimeout = old }()
+	reply(echoes[5])
+	if s.Anomalies.Late != 2 || s.ReceivedPackageCount != 3 {
+		t.Fatal("Error late reply.", s.Anomalies, s.ReceivedPackageCount)
+	}
+}
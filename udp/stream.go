@@ -0,0 +1,144 @@
+package udp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transports a server is reached over.
+const (
+	TransportUDP       = "udp"
+	TransportTCP       = "tcp"
+	TransportWebSocket = "websocket"
+)
+
+// PacketWriter sends a package to a server. Both *net.UDPConn and
+// UdpService, which also knows the streams, implement it.
+type PacketWriter interface {
+	WriteToUDP(data []byte, address *net.UDPAddr) (int, error)
+}
+
+// Streams carry the packages of servers which can't use udp over tcp, either
+// on the same port with each package prefixed with its length, or as
+// websocket messages on the web server of a center.
+const StreamFrameLength = 2
+
+// MaxStreams bounds the streams a server accepts, MaxStreamsPerIp those from
+// one address.
+const MaxStreams = 1024
+const MaxStreamsPerIp = 4
+
+// StreamTimeout bounds connecting a stream, writing to it and reading a
+// frame once it started.
+const StreamTimeout = 5 * time.Second
+
+// streamIdleTimeout closes streams which sent nothing for so long, peers
+// ping each other far more often.
+var streamIdleTimeout = 30 * time.Second
+
+// Stream is a tcp or websocket connection to the server at Address. Packages
+// read from it are handled as if they came from Address, and packages to
+// Address are written to it.
+type Stream struct {
+	Address    *net.UDPAddr
+	Transport  string
+	connection net.Conn
+	reader     *bufio.Reader
+	// client tells if this end dialed the stream, websocket clients mask
+	// their frames.
+	client bool
+	mutex  sync.Mutex
+}
+
+// Write sends one framed package.
+func (s *Stream) Write(data []byte) error {
+	if len(data) > 0xFFFF {
+		return errors.New("Package too large.")
+	}
+	var frame []byte
+	if s.Transport == TransportWebSocket {
+		frame = websocketFrame(websocketBinary, data, s.client)
+	} else {
+		frame = make([]byte, StreamFrameLength+len(data))
+		binary.BigEndian.PutUint16(frame, uint16(len(data)))
+		copy(frame[StreamFrameLength:], data)
+	}
+	return s.write(frame)
+}
+
+func (s *Stream) write(frame []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.connection.SetWriteDeadline(time.Now().Add(StreamTimeout))
+	_, err := s.connection.Write(frame)
+	return err
+}
+
+// read queues the packages of the stream until it fails or stays idle.
+func (s *Stream) read(pipeline *Pipeline) error {
+	if s.reader == nil {
+		s.reader = bufio.NewReader(s.connection)
+	}
+	for {
+		s.connection.SetReadDeadline(time.Now().Add(streamIdleTimeout))
+		if _, err := s.reader.Peek(1); err != nil {
+			return err
+		}
+		s.connection.SetReadDeadline(time.Now().Add(StreamTimeout))
+		buffer := bufferPool.Get().(*[]byte)
+		n, err := s.readFrame(*buffer)
+		if err != nil || n == 0 {
+			bufferPool.Put(buffer)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		pipeline.push(&Package{(*buffer)[:n], s.Address, buffer})
+	}
+}
+
+// readFrame reads the next frame into buffer and returns the size of the
+// package in it, 0 for websocket control frames.
+func (s *Stream) readFrame(buffer []byte) (int, error) {
+	if s.Transport != TransportWebSocket {
+		header := make([]byte, StreamFrameLength)
+		if _, err := io.ReadFull(s.reader, header); err != nil {
+			return 0, err
+		}
+		n := int(binary.BigEndian.Uint16(header))
+		if n == 0 || n > len(buffer) {
+			return 0, errors.New("Wrong frame size.")
+		}
+		_, err := io.ReadFull(s.reader, buffer[:n])
+		return n, err
+	}
+	opcode, n, err := readWebSocketFrame(s.reader, buffer, !s.client)
+	if err != nil {
+		return 0, err
+	}
+	switch opcode {
+	case websocketBinary:
+		if n == 0 {
+			return 0, errors.New("Wrong frame size.")
+		}
+		return n, nil
+	case websocketPing:
+		return 0, s.write(websocketFrame(websocketPong, buffer[:n], s.client))
+	case websocketPong:
+		return 0, nil
+	case websocketClose:
+		s.write(websocketFrame(websocketClose, nil, s.client))
+		return 0, errors.New("Stream closed by peer.")
+	}
+	return 0, errors.New("Unsupported websocket frame.")
+}
+
+func (s *Stream) Close() error {
+	return s.connection.Close()
+}
@@ -0,0 +1,256 @@
+package udp
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// streamService is a service which only serves streams, handing the
+// packages it receives to received.
+func streamService(t *testing.T, received chan *Package) *UdpService {
+	s := &UdpService{ListenNetwork: "udp4", streams: make(map[string]*Stream), done: make(chan struct{})}
+	s.pipeline = (&Pipeline{}).Init(1, 16, func(p *Package) {
+		received <- &Package{Data: append([]byte{}, p.Data...), Address: p.Address}
+	})
+	s.pipeline.Start()
+	return s
+}
+
+func receive(t *testing.T, received chan *Package) *Package {
+	select {
+	case p := <-received:
+		return p
+	case <-time.After(time.Second):
+		t.Fatal("Nothing received.")
+	}
+	return nil
+}
+
+func TestStream(t *testing.T) {
+	serverReceived, clientReceived := make(chan *Package, 4), make(chan *Package, 4)
+	server, client := streamService(t, serverReceived), streamService(t, clientReceived)
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skip("Can't listen tcp.", err)
+	}
+	server.listener = listener
+	server.streamWait.Add(1)
+	go server.acceptLoop()
+	address := listener.Addr().(*net.TCPAddr)
+	serverAddress := &net.UDPAddr{IP: address.IP, Port: address.Port}
+
+	if client.Transport(serverAddress) != TransportUDP {
+		t.Fatal("Stream before dial.")
+	}
+	if err := client.Dial(serverAddress, TransportTCP, ""); err != nil {
+		t.Fatal("Dial failed.", err)
+	}
+	if client.Transport(serverAddress) != TransportTCP {
+		t.Fatal("No stream after dial.")
+	}
+	if _, err := client.WriteToUDP([]byte("ping"), serverAddress); err != nil {
+		t.Fatal("Write failed.", err)
+	}
+	p := receive(t, serverReceived)
+	if string(p.Data) != "ping" || server.Transport(p.Address) != TransportTCP {
+		t.Fatal("Error package from stream.", p)
+	}
+	// Replies to the address of a stream go over it.
+	server.WriteToUDP([]byte("pong"), p.Address)
+	if p = receive(t, clientReceived); string(p.Data) != "pong" || p.Address.String() != serverAddress.String() {
+		t.Fatal("Error reply from stream.", p)
+	}
+
+	close(server.done)
+	server.closeStreams()
+	for i := 0; client.Transport(serverAddress) == TransportTCP; i++ {
+		if i > 100 {
+			t.Fatal("Closed stream kept.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStreamFrame(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	received := make(chan *Package, 4)
+	s := streamService(t, received)
+	stream := &Stream{Address: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}, Transport: TransportTCP, connection: b}
+	result := make(chan error)
+	go func() { result <- stream.read(s.pipeline) }()
+
+	writer := &Stream{Transport: TransportTCP, connection: a}
+	if err := writer.Write(make([]byte, 0x10000)); err == nil {
+		t.Fatal("Oversized package written.")
+	}
+	writer.Write([]byte("one"))
+	if p := receive(t, received); string(p.Data) != "one" || !p.Address.IP.Equal(stream.Address.IP) {
+		t.Fatal("Error frame.", p)
+	}
+	// A frame larger than any package closes the stream.
+	a.Write([]byte{0xFF, 0xFF})
+	if err := <-result; err == nil {
+		t.Fatal("Oversized frame read.")
+	}
+}
+
+func TestStreamIdle(t *testing.T) {
+	defer func(timeout time.Duration) { streamIdleTimeout = timeout }(streamIdleTimeout)
+	streamIdleTimeout = 50 * time.Millisecond
+	a, b := net.Pipe()
+	defer a.Close()
+	s := streamService(t, make(chan *Package, 4))
+	stream := &Stream{Address: &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}, Transport: TransportTCP, connection: b}
+	result := make(chan error)
+	go func() { result <- stream.read(s.pipeline) }()
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Fatal("Idle stream closed without error.")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Idle stream kept.")
+	}
+}
+
+func TestStreamsPerIp(t *testing.T) {
+	s := streamService(t, make(chan *Package, 4))
+	var ends []net.Conn
+	defer func() {
+		close(s.done)
+		s.closeStreams()
+		for _, v := range ends {
+			v.Close()
+		}
+	}()
+	stream := func(ip string, port int, client bool) *Stream {
+		a, b := net.Pipe()
+		ends = append(ends, a)
+		return &Stream{Address: &net.UDPAddr{IP: net.ParseIP(ip), Port: port}, Transport: TransportTCP, connection: b, client: client}
+	}
+	for i := 0; i < MaxStreamsPerIp; i++ {
+		if !s.serve(stream("10.0.0.1", 1000+i, false)) {
+			t.Fatal("Stream refused.", i)
+		}
+	}
+	if s.serve(stream("10.0.0.1", 2000, false)) {
+		t.Fatal("Too many streams from one address.")
+	}
+	if !s.serve(stream("10.0.0.2", 1000, false)) {
+		t.Fatal("Stream from another address refused.")
+	}
+	if !s.serve(stream("10.0.0.1", 3000, true)) {
+		t.Fatal("Dialed stream refused.")
+	}
+}
+
+func TestWebSocketStream(t *testing.T) {
+	serverReceived, clientReceived := make(chan *Package, 4), make(chan *Package, 4)
+	server, client := streamService(t, serverReceived), streamService(t, clientReceived)
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := server.AcceptWebSocket(w, r); err != nil {
+			t.Log("Refused.", err)
+		}
+	}))
+	defer web.Close()
+	serverAddress := &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 12345}
+
+	if err := client.Dial(serverAddress, TransportWebSocket, ""); err == nil {
+		t.Fatal("Dialed websocket without web address.")
+	}
+	if err := client.Dial(serverAddress, TransportWebSocket, web.Listener.Addr().String()); err != nil {
+		t.Fatal("Dial failed.", err)
+	}
+	if client.Transport(serverAddress) != TransportWebSocket {
+		t.Fatal("No stream after dial.")
+	}
+	client.WriteToUDP([]byte("ping"), serverAddress)
+	p := receive(t, serverReceived)
+	if string(p.Data) != "ping" || server.Transport(p.Address) != TransportWebSocket {
+		t.Fatal("Error package from websocket.", p)
+	}
+	server.WriteToUDP([]byte("pong"), p.Address)
+	if p = receive(t, clientReceived); string(p.Data) != "pong" || p.Address.String() != serverAddress.String() {
+		t.Fatal("Error reply from websocket.", p)
+	}
+
+	// Plain requests to the stream path are refused.
+	response, err := http.Get(web.URL + StreamPath)
+	if err != nil {
+		t.Fatal("Get failed.", err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatal("Plain request accepted.", response.StatusCode)
+	}
+
+	close(server.done)
+	server.closeStreams()
+	client.closeStreams()
+}
+
+func TestWebSocketFrame(t *testing.T) {
+	buffer := make([]byte, 64)
+	read := func(frame []byte, fromClient bool) (byte, int, error) {
+		return readWebSocketFrame(bufio.NewReader(bytes.NewReader(frame)), buffer, fromClient)
+	}
+	if opcode, n, err := read(websocketFrame(websocketBinary, []byte("data"), true), true); err != nil ||
+		opcode != websocketBinary || string(buffer[:n]) != "data" {
+		t.Fatal("Error masked frame.", opcode, n, err)
+	}
+	if _, n, err := read(websocketFrame(websocketBinary, []byte("data"), false), false); err != nil || string(buffer[:n]) != "data" {
+		t.Fatal("Error frame.", n, err)
+	}
+	// Clients must mask, servers must not.
+	if _, _, err := read(websocketFrame(websocketBinary, []byte("data"), false), true); err == nil {
+		t.Fatal("Unmasked client frame read.")
+	}
+	if _, _, err := read(websocketFrame(websocketBinary, []byte("data"), true), false); err == nil {
+		t.Fatal("Masked server frame read.")
+	}
+	if _, _, err := read([]byte{0x82, 127, 0, 0, 0, 0, 0, 0, 0, 1}, false); err == nil {
+		t.Fatal("64 bit length read.")
+	}
+	if _, _, err := read(websocketFrame(websocketBinary, make([]byte, 65), false), false); err == nil {
+		t.Fatal("Frame larger than buffer read.")
+	}
+	if _, _, err := read([]byte{0x02, 0}, false); err == nil {
+		t.Fatal("Fragmented frame read.")
+	}
+
+	// Pings are answered, and close ends the stream.
+	a, b := net.Pipe()
+	defer a.Close()
+	stream := &Stream{Transport: TransportWebSocket, connection: b, reader: bufio.NewReader(b)}
+	go a.Write(websocketFrame(websocketPing, []byte("hi"), true))
+	result := make(chan error, 1)
+	go func() {
+		_, err := stream.readFrame(make([]byte, 64))
+		result <- err
+	}()
+	reader := bufio.NewReader(a)
+	if opcode, n, err := readWebSocketFrame(reader, buffer, false); err != nil || opcode != websocketPong || string(buffer[:n]) != "hi" {
+		t.Fatal("Ping not answered.", opcode, n, err)
+	}
+	if err := <-result; err != nil {
+		t.Fatal("Ping failed.", err)
+	}
+	go a.Write(websocketFrame(websocketClose, nil, true))
+	go func() {
+		_, err := stream.readFrame(make([]byte, 64))
+		result <- err
+	}()
+	if opcode, _, err := readWebSocketFrame(reader, buffer, false); err != nil || opcode != websocketClose {
+		t.Fatal("Close not answered.", opcode, err)
+	}
+	if err := <-result; err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Fatal("Close didn't end stream.", err)
+	}
+}
@@ -6,23 +6,162 @@ import (
 	"errors"
 	"net"
 	"math"
+	"sync/atomic"
+	"time"
 )
 
-const ServerInfoLength = 26
-const SyncPackageHeader = 15
+// ServerInfoLength and SyncPackageHeader are the fixed parts of a server
+// entry and of the sync header; each address adds addressLength bytes.
+// Legacy (version 0) packages only carry IPv4 addresses and use the
+// LegacyServerInfoLength and LegacySyncPackageHeader sizes. Packages before
+// AuthVersion carry the token after the port, TokenLength more bytes.
+const ServerInfoLength = 27
+const SyncPackageHeader = 2
+const TokenLength = 8
+const FragmentLength = 8
+const DeltaLength = 16
+
+const ServerRemoved = 1
+
+// MaxFragments bounds the fragments of one sync message.
+const MaxFragments = 256
+const LegacyServerInfoLength = 26
+const LegacySyncPackageHeader = 14
+const SyncPackageSize = 1024
 
 type ServerInfo struct {
-	Ip          net.IP
-	Port        uint16
-	Latency     uint64
-	PackageLost float32
-	LastOnline  uint64
+	Ip           net.IP
+	Port         uint16
+	Latency      uint64
+	PackageLost  float32
+	LastOnline   uint64
+	Version      byte
+	Capabilities uint32
+	NodeId       NodeId
+	Removed      bool
+}
+
+func (s *ServerInfo) length(version byte) int {
+	if version == 0 {
+		return LegacyServerInfoLength
+	}
+	if version >= DeltaVersion {
+		return addressLength(s.Ip) + ServerInfoLength + NodeIdLength + 1
+	}
+	if version >= NodeVersion {
+		return addressLength(s.Ip) + ServerInfoLength + NodeIdLength
+	}
+	return addressLength(s.Ip) + ServerInfoLength
+}
+
+func (s *ServerInfo) toData(version byte, data []byte) int {
+	start := 0
+	if version == 0 {
+		copy(data[0:4], s.Ip.To4())
+		start = 4
+	} else {
+		start = putAddress(data, s.Ip)
+	}
+	binary.BigEndian.PutUint16(data[start:start+2], s.Port)
+	start += 2
+	if version > 0 {
+		data[start] = s.Version
+		binary.BigEndian.PutUint32(data[start+1:start+5], s.Capabilities)
+		start += 5
+	}
+	if version >= NodeVersion {
+		copy(data[start:start+NodeIdLength], s.NodeId[:])
+		start += NodeIdLength
+	}
+	if version >= DeltaVersion {
+		data[start] = 0
+		if s.Removed {
+			data[start] |= ServerRemoved
+		}
+		start++
+	}
+	binary.BigEndian.PutUint64(data[start:start+8], s.Latency)
+	binary.BigEndian.PutUint32(data[start+8:start+12], math.Float32bits(s.PackageLost))
+	binary.BigEndian.PutUint64(data[start+12:start+20], s.LastOnline)
+	return start + 20
+}
+
+func (s *ServerInfo) loadFromData(version byte, data []byte) (int, error) {
+	start := 0
+	if version == 0 {
+		if len(data) < LegacyServerInfoLength {
+			return 0, errors.New("Server info truncated.")
+		}
+		s.Ip = make(net.IP, 4)
+		copy(s.Ip, data[0:4])
+		start = 4
+	} else {
+		ip, length, err := readAddress(data)
+		if err != nil {
+			return 0, err
+		}
+		s.Ip = ip
+		if ip == nil {
+			return 0, errors.New("Server info without address.")
+		}
+		if len(data) < s.length(version) {
+			return 0, errors.New("Server info truncated.")
+		}
+		start = length
+	}
+	s.Port = binary.BigEndian.Uint16(data[start : start+2])
+	start += 2
+	if version > 0 {
+		s.Version = data[start]
+		s.Capabilities = binary.BigEndian.Uint32(data[start+1 : start+5])
+		start += 5
+	}
+	if version >= NodeVersion {
+		copy(s.NodeId[:], data[start:start+NodeIdLength])
+		start += NodeIdLength
+	}
+	if version >= DeltaVersion {
+		if data[start]&^ServerRemoved != 0 {
+			return 0, errors.New("Unknown server flags.")
+		}
+		s.Removed = data[start]&ServerRemoved != 0
+		start++
+	}
+	s.Latency = binary.BigEndian.Uint64(data[start : start+8])
+	s.PackageLost = math.Float32frombits(binary.BigEndian.Uint32(data[start+8 : start+12]))
+	s.LastOnline = binary.BigEndian.Uint64(data[start+12 : start+20])
+	// Older servers announce NaN before the first echo is answered.
+	if math.IsNaN(float64(s.PackageLost)) {
+		s.PackageLost = 1
+	}
+	if s.PackageLost < 0 || s.PackageLost > 1 {
+		return 0, errors.New("Wrong package lost.")
+	}
+	return start + 20, nil
 }
 
+// SyncPackage tells the receiver its own address as seen by the sender in
+// Self, describes the sender in Node and lists the servers the sender knows.
+// The center sends its peer state at StateVersion, as a delta since
+// BaseVersion or in full when BaseVersion is 0. Clients send the version they
+// hold in BaseVersion.
 type SyncPackage struct {
-	Self    ServerInfo
-	Token   uint64
-	Servers *arraystack.Stack
+	Self         ServerInfo
+	Node         NodeInfo
+	Token        uint64
+	MessageId    uint32
+	Index        uint16
+	Total        uint16
+	StateVersion uint64
+	BaseVersion  uint64
+	Parameters   Parameters
+	Servers      *arraystack.Stack
+}
+
+var messageId = uint32(time.Now().UnixNano())
+
+func nextMessageId() uint32 {
+	return atomic.AddUint32(&messageId, 1)
 }
 
 func (s *SyncPackage) Init() *SyncPackage {
@@ -30,59 +169,193 @@ func (s *SyncPackage) Init() *SyncPackage {
 	return s
 }
 
-func (s *SyncPackage) ToData() (all_data map[int][]byte, n int) {
+func (s *SyncPackage) headerLength(version byte) int {
+	if version == 0 {
+		return LegacySyncPackageHeader
+	}
+	if version < AuthVersion {
+		return addressLength(s.Self.Ip) + SyncPackageHeader + TokenLength
+	}
+	if version >= ParametersVersion {
+		return addressLength(s.Self.Ip) + SyncPackageHeader + s.Node.length() + FragmentLength + DeltaLength +
+			s.Parameters.length()
+	}
+	if version >= DeltaVersion {
+		return addressLength(s.Self.Ip) + SyncPackageHeader + s.Node.length() + FragmentLength + DeltaLength
+	}
+	if version >= FragmentVersion {
+		return addressLength(s.Self.Ip) + SyncPackageHeader + s.Node.length() + FragmentLength
+	}
+	if version >= NodeVersion {
+		return addressLength(s.Self.Ip) + SyncPackageHeader + s.Node.length()
+	}
+	return addressLength(s.Self.Ip) + SyncPackageHeader
+}
+
+func (s *SyncPackage) putHeader(version byte, data []byte) {
+	start := 0
+	if version == 0 {
+		copy(data[0:4], s.Self.Ip.To4())
+		start = 4
+	} else {
+		start = putAddress(data, s.Self.Ip)
+	}
+	binary.BigEndian.PutUint16(data[start:start+2], s.Self.Port)
+	if version < AuthVersion {
+		binary.BigEndian.PutUint64(data[start+2:start+10], s.Token)
+	}
+	if version >= NodeVersion {
+		start += s.Node.toData(data[start+2:])
+	}
+	if version >= FragmentVersion {
+		binary.BigEndian.PutUint32(data[start+2:start+6], s.MessageId)
+		binary.BigEndian.PutUint16(data[start+6:start+8], s.Index)
+		binary.BigEndian.PutUint16(data[start+8:start+10], s.Total)
+	}
+	if version >= DeltaVersion {
+		binary.BigEndian.PutUint64(data[start+10:start+18], s.StateVersion)
+		binary.BigEndian.PutUint64(data[start+18:start+26], s.BaseVersion)
+	}
+	if version >= ParametersVersion {
+		s.Parameters.toData(data[start+26:])
+	}
+}
+
+// ToData encodes the package with header, splitting the servers over as many
+// packages as needed. Legacy packages silently drop non IPv4 servers.
+// Authenticated packages are signed and do not carry the token. Starting
+// with FragmentVersion a message is sent even without any server.
+func (s *SyncPackage) ToData(header *Header) (all_data map[int][]byte, n int) {
 	all_data = make(map[int]([]byte))
 	n = 0
+	s.MessageId = nextMessageId()
+	offsets := make([]int, 0)
 	for {
 		i := 0
-		data := make([]byte, 1024)
-		for i < (1024-SyncPackageHeader)/ServerInfoLength {
-			start := i*ServerInfoLength + SyncPackageHeader
-			v, ok := s.Servers.Pop()
-			if ok {
-				server := v.(*ServerInfo)
-				copy(data[start:start+4], server.Ip.To4())
-				binary.BigEndian.PutUint16(data[start+4:start+6], server.Port)
-				binary.BigEndian.PutUint64(data[start+6:start+14], server.Latency)
-				binary.BigEndian.PutUint32(data[start+14:start+18], math.Float32bits(server.PackageLost))
-				binary.BigEndian.PutUint64(data[start+18:start+26], server.LastOnline)
-				i++
-			} else {
+		size := SyncPackageSize - header.Overhead()
+		data, offset := header.ToData(size - header.Length())
+		start := offset + s.headerLength(header.Version)
+		for {
+			v, ok := s.Servers.Peek()
+			if !ok {
+				break
+			}
+			server := v.(*ServerInfo)
+			if header.Version == 0 && server.Ip.To4() == nil {
+				s.Servers.Pop()
+				continue
+			}
+			if start+server.length(header.Version) > size {
 				break
 			}
+			s.Servers.Pop()
+			start += server.toData(header.Version, data[start:])
+			i++
 		}
-		if i > 0 {
-			data[0] = 2
-			copy(data[1:5], s.Self.Ip.To4())
-			binary.BigEndian.PutUint16(data[5:7], s.Self.Port)
-			binary.BigEndian.PutUint64(data[7:15], s.Token)
-			all_data[n] = data[0:i*ServerInfoLength+SyncPackageHeader]
+		if i > 0 || (n == 0 && header.Version >= FragmentVersion) {
+			all_data[n] = data[0:start]
+			offsets = append(offsets, offset)
 			n++
 		} else {
 			break
 		}
 	}
+	s.Total = uint16(n)
+	for i := 0; i < n; i++ {
+		s.Index = uint16(i)
+		s.putHeader(header.Version, all_data[i][offsets[i]:])
+		all_data[i] = header.Seal(all_data[i])
+	}
 	return all_data, n
 }
 
-func (s *SyncPackage) LoadFromData(data []byte, n int) error {
-	server_count := (n - SyncPackageHeader) / ServerInfoLength
-	if server_count*ServerInfoLength+SyncPackageHeader != n {
-		log.Warning("Wrong package received. Type 2.")
-		return errors.New("Wrong package size.")
+// DecodeSync is the codec of sync packages.
+func DecodeSync(header *Header, payload []byte) (interface{}, error) {
+	p := (&SyncPackage{}).Init()
+	if err := p.LoadFromData(header, payload); err != nil {
+		return nil, err
 	}
+	return p, nil
+}
+
+// LoadFromData decodes the payload of a sync package sent with header.
+func (s *SyncPackage) LoadFromData(header *Header, data []byte) error {
 	s.Init()
-	s.Self = ServerInfo{make(net.IP, 4), binary.BigEndian.Uint16(data[5:7]), 0, 0, 0}
-	copy(s.Self.Ip, data[1:5])
-	s.Token = binary.BigEndian.Uint64(data[7:15])
-	for i := 0; i < server_count; i++ {
-		start := SyncPackageHeader + i*ServerInfoLength
-		server := ServerInfo{make(net.IP, 4),
-							 binary.BigEndian.Uint16(data[start+4:start+6]),
-							 binary.BigEndian.Uint64(data[start+6:start+14]),
-							 math.Float32frombits(binary.BigEndian.Uint32(data[start+14:start+18])),
-							 binary.BigEndian.Uint64(data[start+18:start+26])}
-		copy(server.Ip, data[start:start+4])
+	start := 0
+	if header.Version == 0 {
+		if len(data) < LegacySyncPackageHeader {
+			log.Warning("Wrong package received. Type 2.")
+			return errors.New("Wrong package size.")
+		}
+		s.Self.Ip = make(net.IP, 4)
+		copy(s.Self.Ip, data[0:4])
+		start = 4
+	} else {
+		ip, length, err := readAddress(data)
+		fixed := SyncPackageHeader
+		if header.Version < AuthVersion {
+			fixed += TokenLength
+		}
+		if err != nil || len(data) < length+fixed {
+			log.Warning("Wrong package received. Type 2.")
+			return errors.New("Wrong package size.")
+		}
+		s.Self.Ip = ip
+		start = length
+	}
+	s.Self.Port = binary.BigEndian.Uint16(data[start : start+2])
+	start += 2
+	if header.Version < AuthVersion {
+		s.Token = binary.BigEndian.Uint64(data[start : start+8])
+		start += 8
+	}
+	if header.Version >= NodeVersion {
+		length, err := s.Node.loadFromData(data[start:])
+		if err != nil {
+			log.Warning("Wrong package received. Type 2.")
+			return err
+		}
+		start += length
+	}
+	if header.Version >= FragmentVersion {
+		if len(data) < start+FragmentLength {
+			log.Warning("Wrong package received. Type 2.")
+			return errors.New("Wrong package size.")
+		}
+		s.MessageId = binary.BigEndian.Uint32(data[start : start+4])
+		s.Index = binary.BigEndian.Uint16(data[start+4 : start+6])
+		s.Total = binary.BigEndian.Uint16(data[start+6 : start+8])
+		start += FragmentLength
+		if s.Index >= s.Total || s.Total > MaxFragments {
+			log.Warning("Wrong package received. Type 2.")
+			return errors.New("Wrong fragment index.")
+		}
+	}
+	if header.Version >= DeltaVersion {
+		if len(data) < start+DeltaLength {
+			log.Warning("Wrong package received. Type 2.")
+			return errors.New("Wrong package size.")
+		}
+		s.StateVersion = binary.BigEndian.Uint64(data[start : start+8])
+		s.BaseVersion = binary.BigEndian.Uint64(data[start+8 : start+16])
+		start += DeltaLength
+	}
+	if header.Version >= ParametersVersion {
+		length, err := s.Parameters.loadFromData(data[start:])
+		if err != nil {
+			log.Warning("Wrong package received. Type 2.")
+			return err
+		}
+		start += length
+	}
+	for start < len(data) {
+		server := ServerInfo{}
+		length, err := server.loadFromData(header.Version, data[start:])
+		if err != nil {
+			log.Warning("Wrong package received. Type 2.")
+			return err
+		}
+		start += length
 		s.Servers.Push(&server)
 	}
 	return nil
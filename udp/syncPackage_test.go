@@ -16,12 +16,17 @@ func TestSyncPackageParser(t *testing.T) {
 		333,
 		184932,
 		0.8,
-		uint64(time.Now().UnixNano())}
+		uint64(time.Now().UnixNano()),
+		ProtocolVersion,
+		LocalCapabilities,
+		NodeId{1, 2, 3},
+		false}
 	p.Servers.Push(&s)
 
-	d, _ := p.ToData()
+	d, _ := p.ToData(NewHeader(PackageTypeSync, ProtocolVersion, LocalCapabilities))
+	h, payload, _ := LoadHeader(d[0])
 	r := (&SyncPackage{}).Init()
-	r.LoadFromData(d[0], 41)
+	r.LoadFromData(h, payload)
 	if !p.Self.Ip.Equal(r.Self.Ip) {
 		log.Fatal("Error self ip.", p.Self.Ip, r.Self.Ip)
 	}
@@ -33,4 +38,58 @@ func TestSyncPackageParser(t *testing.T) {
 	if !s.Ip.Equal(rs.Ip) {
 		log.Fatal("Error server ip.", s.Ip, rs.Ip)
 	}
+	if s.NodeId != rs.NodeId {
+		t.Fatal("Error server node id.", s.NodeId, rs.NodeId)
+	}
+}
+
+func TestSyncPackageParserIPv6(t *testing.T) {
+	p := (&SyncPackage{}).Init()
+	p.Self.Ip = net.ParseIP("2001:da8:201::1")
+	p.Self.Port = 555
+	p.Token = 123
+	p.Node = NodeInfo{NodeId{9}, "gateway", map[string]string{"site": "yanyuan", "role": "client"}}
+	for i := 0; i < 60; i++ {
+		ip := net.ParseIP("2001:da8:201::100")
+		ip[15] = byte(i)
+		if i%2 == 0 {
+			ip = net.IPv4(10, 3, 5, byte(i))
+		}
+		p.Servers.Push(&ServerInfo{ip, uint16(i), 184932, 0.8, uint64(time.Now().UnixNano()), ProtocolVersion, 0, NodeId{byte(i)}, i%3 == 0})
+	}
+
+	d, n := p.ToData(NewHeader(PackageTypeSync, ProtocolVersion, LocalCapabilities))
+	if n < 2 {
+		t.Fatal("Expected package to be split.", n)
+	}
+	count := 0
+	for i := 0; i < n; i++ {
+		if len(d[i]) > SyncPackageSize {
+			t.Fatal("Package too large.", len(d[i]))
+		}
+		h, payload, err := LoadHeader(d[i])
+		if err != nil {
+			t.Fatal("Load header failed.", err)
+		}
+		r := (&SyncPackage{}).Init()
+		if err := r.LoadFromData(h, payload); err != nil {
+			t.Fatal("Load package failed.", err)
+		}
+		if !p.Self.Ip.Equal(r.Self.Ip) || !h.Authenticated {
+			t.Fatal("Error self.", r.Self.Ip, r.Token)
+		}
+		if r.Node.Id != p.Node.Id || r.Node.Name != "gateway" || r.Node.Labels["site"] != "yanyuan" || len(r.Node.Labels) != 2 {
+			t.Fatal("Error node info.", r.Node)
+		}
+		for _, v := range r.Servers.Values() {
+			rs := v.(*ServerInfo)
+			if (rs.Port%2 == 0) != (rs.Ip.To4() != nil) || rs.NodeId[0] != byte(rs.Port) || rs.Removed != (rs.Port%3 == 0) {
+				t.Fatal("Error server ip family.", rs.Port, rs.Ip)
+			}
+			count++
+		}
+	}
+	if count != 60 {
+		t.Fatal("Error server count.", count)
+	}
 }
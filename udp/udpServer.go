@@ -1,12 +1,22 @@
 package udp
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 	"github.com/Catofes/go-its/config"
+	"errors"
 	"net"
+	"strings"
 	"github.com/op/go-logging"
 	Log "github.com/Catofes/go-its/log"
 	"sync"
 	"strconv"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"time"
 )
 
 var log *logging.Logger
@@ -17,86 +27,381 @@ func init() {
 	log = Log.GetInstance()
 }
 
-type Handler func(*net.UDPConn, *net.UDPAddr, int, []byte)
 type UdpService struct {
-	ListenAddress string
-	ListenPort    int
-	buffer        []byte
-	mutex         sync.Mutex
-	handler       map[byte]Handler
-	connection    *net.UDPConn
-	isServer      bool
+	ListenAddress   string
+	ListenPort      int
+	ListenNetwork   string
+	Streams         []string
+	RequireAuth     bool
+	RequireIdentity bool
+	pipeline        *Pipeline
+	limiter         *RateLimiter
+	access          AccessList
+	router          *Router
+	Metrics         Metrics
+	connection      *net.UDPConn
+	listener        net.Listener
+	streams         map[string]*Stream
+	streamMutex     sync.Mutex
+	streamWait      sync.WaitGroup
+	done            chan struct{}
+	isServer        bool
 }
 
 func (s *UdpService) loadConfig() {
 	c := config.GetInstance("")
 	s.ListenAddress = c.ListenAddress
 	s.ListenPort = int(c.ListenPort)
+	s.ListenNetwork = c.ListenNetwork
+	s.Streams = c.Streams
+	for _, v := range s.Streams {
+		if v != TransportTCP && v != TransportWebSocket {
+			log.Fatal("Unknown stream transport: ", v)
+		}
+	}
+	s.RequireAuth = c.RequireAuth
+	if c.Key != "" {
+		SetKey([]byte(c.Key))
+	} else {
+		key := make([]byte, 8)
+		binary.BigEndian.PutUint64(key, c.Token)
+		SetKey(key)
+	}
+	if err := SetEncryptKeys(c.EncryptKeys); err != nil {
+		log.Fatal("Can't load encrypt keys: ", err)
+	}
+	if c.Identity != 0 {
+		key, err := hex.DecodeString(c.IdentityKey)
+		if err != nil || len(key) == 0 {
+			log.Fatal("Can't load identity key: ", err)
+		}
+		SetIdentity(c.Identity, key)
+	}
+	if c.CredentialFile != "" {
+		SetCredentials((&CredentialStore{}).Init(c.CredentialFile))
+	}
+	s.RequireIdentity = c.RequireIdentity
+	s.limiter = (&RateLimiter{}).Init(float64(c.RateLimit), float64(c.RateBurst))
+	var err error
+	if s.access.Allow, err = ParseNetworks(c.AllowNetworks); err != nil {
+		log.Fatal("Can't load allowed networks: ", err)
+	}
+	if s.access.Deny, err = ParseNetworks(c.DenyNetworks); err != nil {
+		log.Fatal("Can't load denied networks: ", err)
+	}
+	s.pipeline = (&Pipeline{}).Init(int(c.Workers), int(c.QueueLength), s.handlePackage)
+	s.pipeline.Filter = s.filter
+	s.router = (&Router{}).Init()
+	s.router.Use(s.Metrics.Middleware, Authenticate(s.RequireAuth, s.RequireIdentity))
+	if c.Trace {
+		s.router.Use(Trace)
+	}
+}
+
+// filter drops packages from denied or flooding sources before they are
+// queued.
+func (s *UdpService) filter(p *Package) bool {
+	if !s.access.Permit(p.Address.IP) {
+		countDrop(&drops.Denied)
+		return false
+	}
+	if !s.limiter.Allow(p.Address.IP, time.Now()) {
+		countDrop(&drops.RateLimited)
+		return false
+	}
+	return true
 }
 
 func (s *UdpService) Init() *UdpService {
 	s.loadConfig()
-	s.buffer = make([]byte, 1024)
-	s.handler = make(map[byte]Handler, 5)
+	s.streams = make(map[string]*Stream)
 	return s
 }
 
-func (s *UdpService) Loop() {
-	address, err := net.ResolveUDPAddr("udp", s.ListenAddress+":"+strconv.Itoa(s.ListenPort))
+// Listen opens the connection Loop reads from, and if enabled the tcp
+// listener for streams on the same port.
+func (s *UdpService) Listen() {
+	address, err := net.ResolveUDPAddr(s.ListenNetwork, net.JoinHostPort(s.ListenAddress, strconv.Itoa(s.ListenPort)))
 	if err != nil {
 		log.Fatal("Can't resolve address: ", err)
 	}
-	connection, err := net.ListenUDP("udp", address)
+	connection, err := net.ListenUDP(s.ListenNetwork, address)
 	s.connection = connection
 	if err != nil {
 		log.Fatal("Can't listen udp on", address, err)
 	}
-	defer s.connection.Close()
+	s.done = make(chan struct{})
+	if !s.Accepts(TransportTCP) {
+		return
+	}
+	network := strings.Replace(s.ListenNetwork, "udp", "tcp", 1)
+	if s.listener, err = net.Listen(network, address.String()); err != nil {
+		log.Warning("Can't listen tcp on %s, no streams. %s", address.String(), err.Error())
+	}
+}
+
+func (s *UdpService) Loop() {
+	defer mainWaitGroup.Done()
+	s.pipeline.Start()
+	if s.listener != nil {
+		s.streamWait.Add(1)
+		go s.acceptLoop()
+	}
 	for {
-		s.handleClient(s.connection)
+		if err := s.pipeline.Read(s.connection); err != nil {
+			select {
+			case <-s.done:
+				s.pipeline.Stop()
+				return
+			default:
+			}
+			log.Warning("Error read connection. %s", err.Error())
+		}
+	}
+}
+
+// acceptLoop serves the streams of servers which fell back to tcp.
+func (s *UdpService) acceptLoop() {
+	defer s.streamWait.Done()
+	for {
+		connection, err := s.listener.Accept()
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			log.Warning("Error accept stream. %s", err.Error())
+			continue
+		}
+		address := connection.RemoteAddr().(*net.TCPAddr)
+		s.serve(&Stream{Address: &net.UDPAddr{IP: address.IP, Port: address.Port}, Transport: TransportTCP, connection: connection})
+	}
+}
+
+// Accepts tells if streams over transport are accepted.
+func (s *UdpService) Accepts(transport string) bool {
+	for _, v := range s.Streams {
+		if v == transport {
+			return true
+		}
 	}
+	return false
 }
 
-func (s *UdpService) handleClient(connection *net.UDPConn) {
-	n, remoteAddress, err := connection.ReadFromUDP(s.buffer)
+// AcceptWebSocket serves the stream of a server which fell back to
+// websocket, on the web server.
+func (s *UdpService) AcceptWebSocket(w http.ResponseWriter, r *http.Request) error {
+	host, port, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
-		log.Warning("Error read connection. %s", err.Error())
-		return
+		return err
+	}
+	number, _ := strconv.Atoi(port)
+	address := &net.UDPAddr{IP: net.ParseIP(host), Port: number}
+	if !s.access.Permit(address.IP) {
+		countDrop(&drops.Denied)
+		http.Error(w, "Denied.", http.StatusForbidden)
+		return errors.New("Denied.")
+	}
+	connection, reader, err := upgradeWebSocket(w, r)
+	if err != nil {
+		return err
+	}
+	if !s.serve(&Stream{Address: address, Transport: TransportWebSocket, connection: connection, reader: reader}) {
+		return errors.New("Stream refused.")
+	}
+	return nil
+}
+
+// serve reads stream until it fails, meanwhile packages to its address go
+// over it. A new stream from the same address replaces the old one.
+func (s *UdpService) serve(stream *Stream) bool {
+	key := stream.Address.String()
+	s.streamMutex.Lock()
+	defer s.streamMutex.Unlock()
+	select {
+	case <-s.done:
+		stream.Close()
+		return false
+	default:
+	}
+	// Streams this server dialed aren't limited per address.
+	if !s.access.Permit(stream.Address.IP) || len(s.streams) >= MaxStreams ||
+		!stream.client && s.streamsFrom(stream.Address.IP) >= MaxStreamsPerIp {
+		countDrop(&drops.Denied)
+		stream.Close()
+		return false
 	}
-	//log.Debug("Get connection from %s, size %d.", remoteAddress.String(), n)
-	if n <= 0 {
+	if old, ok := s.streams[key]; ok {
+		old.Close()
+	}
+	s.streams[key] = stream
+	s.streamWait.Add(1)
+	go func() {
+		defer s.streamWait.Done()
+		err := stream.read(s.pipeline)
+		log.Info("Stream %s closed. %s", key, err.Error())
+		s.streamMutex.Lock()
+		if s.streams[key] == stream {
+			delete(s.streams, key)
+		}
+		s.streamMutex.Unlock()
+		stream.Close()
+	}()
+	return true
+}
+
+// streamsFrom counts the streams from ip.
+func (s *UdpService) streamsFrom(ip net.IP) int {
+	n := 0
+	for _, v := range s.streams {
+		if v.Address.IP.Equal(ip) {
+			n++
+		}
+	}
+	return n
+}
+
+// Dial connects a stream over transport to the server at address, so
+// packages to it go over the stream. Websocket streams connect to the web
+// server at web.
+func (s *UdpService) Dial(address *net.UDPAddr, transport string, web string) error {
+	network := strings.Replace(s.ListenNetwork, "udp", "tcp", 1)
+	stream := &Stream{Address: address, Transport: transport, client: true}
+	var err error
+	switch transport {
+	case TransportTCP:
+		stream.connection, err = net.DialTimeout(network, address.String(), StreamTimeout)
+	case TransportWebSocket:
+		if web == "" {
+			return errors.New("No web address.")
+		}
+		stream.connection, stream.reader, err = dialWebSocket(network, web)
+	default:
+		return errors.New("Unknown stream transport.")
+	}
+	if err != nil {
+		return err
+	}
+	if !s.serve(stream) {
+		return errors.New("Stream refused.")
+	}
+	return nil
+}
+
+// Transport tells how packages to address are sent.
+func (s *UdpService) Transport(address *net.UDPAddr) string {
+	s.streamMutex.Lock()
+	defer s.streamMutex.Unlock()
+	if stream, ok := s.streams[address.String()]; ok {
+		return stream.Transport
+	}
+	return TransportUDP
+}
+
+// WriteToUDP sends data to address, over its stream if it has one.
+func (s *UdpService) WriteToUDP(data []byte, address *net.UDPAddr) (int, error) {
+	if len(data) == 0 {
+		return 0, errors.New("Nothing to send.")
+	}
+	s.streamMutex.Lock()
+	stream := s.streams[address.String()]
+	s.streamMutex.Unlock()
+	if stream == nil {
+		return s.connection.WriteToUDP(data, address)
+	}
+	if err := stream.Write(data); err != nil {
+		// The reader notices and forgets the stream.
+		stream.Close()
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Stop closes the connections and waits until the queued packages are
+// handled.
+func (s *UdpService) Stop() {
+	close(s.done)
+	s.closeStreams()
+	s.connection.Close()
+	mainWaitGroup.Wait()
+}
+
+// closeStreams stops accepting streams, closes them and waits until their
+// packages are queued.
+func (s *UdpService) closeStreams() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.streamMutex.Lock()
+	for _, v := range s.streams {
+		v.Close()
+	}
+	s.streamMutex.Unlock()
+	s.streamWait.Wait()
+}
+
+// handlePackage runs on the pipeline workers, so handlers may be called
+// concurrently and must not keep the payload after they return.
+func (s *UdpService) handlePackage(p *Package) {
+	header, payload, err := LoadHeader(p.Data)
+	// Registrations answer authentication failures with the reason.
+	if err != nil && (header == nil || (header.Type != PackageTypeRegister && header.Type != PackageTypeRegisterAck)) {
+		log.Info("Receive wrong package from %s. %s", p.Address.String(), err.Error())
+		countDrop(&drops.Malformed)
 		return
 	}
-	packageType := s.buffer[0]
-	s.mutex.Lock()
-	if handler, ok := s.handler[packageType]; ok {
-		s.mutex.Unlock()
-		handler(connection, remoteAddress, n, s.buffer)
-	} else {
-		s.mutex.Unlock()
+	if !s.router.Dispatch(&Request{s, p.Address, header, payload, nil}) {
 		log.Warning("Receive unknown package.")
+		countDrop(&drops.UnknownType)
 	}
 }
 
-func (s *UdpService) AddHandler(packageType byte, handler Handler) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	s.handler[packageType] = handler
+// knownPeer reports whether addr belongs to a server the service tracks,
+// which accepts header.
+func knownPeer(addr *net.UDPAddr, header *Header) bool {
+	if service == nil {
+		return false
+	}
+	service.Mutex.Lock()
+	defer service.Mutex.Unlock()
+	_, v := service.findByAddress(addr.IP, uint16(addr.Port))
+	return v != nil && v.accept(header, service.maxAge)
 }
 
-func (s *UdpService) DeleteHandler(packageType byte) {
-	s.mutex.Lock()
-	defer s.mutex.Unlock()
-	delete(s.handler, packageType)
+func (s *UdpService) Stats() PipelineStats {
+	return s.pipeline.Stats()
 }
 
+// Register sets the codec and handler of a package type.
+func (s *UdpService) Register(packageType byte, codec Codec, handler MessageHandler) {
+	s.router.Register(packageType, codec, handler)
+}
+
+func (s *UdpService) Unregister(packageType byte) {
+	s.router.Unregister(packageType)
+}
+
+// Run runs until SIGINT or SIGTERM.
 func Run(isServer bool) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	RunContext(ctx, isServer)
+}
+
+// RunContext runs until ctx is done, then stops the loops, says goodbye to
+// the other servers and handles the packages already received.
+func RunContext(ctx context.Context, isServer bool) {
 	udpService = (&UdpService{}).Init()
 	udpService.isServer = isServer
-	udpService.AddHandler(byte(0), EchoRequestHandler)
+	udpService.Register(PackageTypeEchoRequest, DecodeEcho, EchoRequestHandler)
+	udpService.Listen()
 	mainWaitGroup.Add(1)
 	go udpService.Loop()
 	service = (&MainService{}).Init()
-	service.Loop()
-	mainWaitGroup.Wait()
+	service.Loop(ctx)
+	<-ctx.Done()
+	log.Warning("Shutting down.")
+	service.Stop()
+	udpService.Stop()
 }
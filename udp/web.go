@@ -5,17 +5,21 @@ import (
 	"gopkg.in/kataras/iris.v6/adaptors/httprouter"
 	"github.com/Catofes/go-its/its"
 	"github.com/Catofes/go-its/config"
+	"crypto/subtle"
+	"strconv"
 )
 
 type WebServer struct {
-	app     *iris.Framework
-	address string
+	app        *iris.Framework
+	address    string
+	adminToken string
 }
 
 func (s *WebServer) Init() *WebServer {
 	s.app = iris.New()
 	s.app.Adapt(httprouter.New())
 	s.address = config.GetInstance("").WebServerAddress
+	s.adminToken = config.GetInstance("").AdminToken
 	s.bind()
 	return s
 }
@@ -27,6 +31,34 @@ func (s *WebServer) Run() {
 func (s *WebServer) bind() {
 	s.app.Get("/", s.get_status)
 	s.app.Post("/", s.connect)
+	if udpService.Accepts(TransportWebSocket) {
+		s.app.Get(StreamPath, s.stream)
+	}
+	if credentials != nil && s.adminToken != "" {
+		s.app.Get("/credentials", s.admin, s.listCredentials)
+		s.app.Post("/credentials", s.admin, s.addCredential)
+		s.app.Delete("/credentials/:id", s.admin, s.revokeCredential)
+	} else if credentials != nil {
+		log.Warning("No admin token, credentials can't be managed over the web.")
+	}
+}
+
+// admin only lets requests with the admin token through.
+func (s *WebServer) admin(ctx *iris.Context) {
+	if !adminAuthorized(ctx.RequestHeader("Authorization"), s.adminToken) {
+		ctx.JSON(iris.StatusUnauthorized, map[string]interface{}{"error": "Unauthorized."})
+		return
+	}
+	ctx.Next()
+}
+
+// adminAuthorized tells if authorization carries token as a bearer token.
+func adminAuthorized(authorization string, token string) bool {
+	if token == "" {
+		return false
+	}
+	expected := "Bearer " + token
+	return subtle.ConstantTimeCompare([]byte(authorization), []byte(expected)) == 1
 }
 
 func (s *WebServer) get_status(ctx *iris.Context) {
@@ -34,14 +66,65 @@ func (s *WebServer) get_status(ctx *iris.Context) {
 	response["check_status"] = its.ItsManager.Status
 	response["last_check_time"] = its.ItsManager.LastCheckTime.Format("2006-01-02 15:04:05.999999999 -0700 MST")
 	response["last_connect_time"] = its.ItsManager.LastConnectTime.Format("2006-01-02 15:04:05.999999999 -0700 MST")
+	response["session_expire_time"] = its.ItsManager.SessionExpireTime.Format("2006-01-02 15:04:05.999999999 -0700 MST")
 	response["last_connect_response"] = its.ItsManager.LastText
 	response["lost_count"] = its.ItsManager.LostCount
 	response["lost_limit"] = its.ItsManager.LostLimit
+	response["dry_run"] = its.ItsManager.DryRun
+	response["journal"] = its.ItsManager.Journal.Entries()
+	response["replay_rejected"] = service.ReplayRejected()
+	response["probe_anomalies"] = service.ProbeAnomalies()
+	response["pipeline"] = udpService.Stats()
+	response["drops"] = Drops()
+	response["messages"] = udpService.Metrics.Types()
+	response["departed"] = service.DepartedCount()
+	response["parameters"] = service.ReportedParameters()
+	response["leader"] = service.Leadership()
+	response["transports"] = service.Transports()
 	response["debug"] = service.Servers
 	ctx.JSON(iris.StatusOK, response)
 }
 
+func (s *WebServer) listCredentials(ctx *iris.Context) {
+	ctx.JSON(iris.StatusOK, credentials.List())
+}
+
+// addCredential creates a client credential. Its key is only returned here.
+func (s *WebServer) addCredential(ctx *iris.Context) {
+	credential, err := credentials.Add(ctx.FormValue("name"))
+	if err != nil {
+		ctx.JSON(iris.StatusInternalServerError, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	ctx.JSON(iris.StatusOK, credential)
+}
+
+func (s *WebServer) revokeCredential(ctx *iris.Context) {
+	id, err := strconv.ParseUint(ctx.Param("id"), 10, 32)
+	if err != nil {
+		ctx.JSON(iris.StatusBadRequest, map[string]interface{}{"error": "Wrong identity."})
+		return
+	}
+	if err := credentials.Revoke(uint32(id)); err != nil {
+		ctx.JSON(iris.StatusNotFound, map[string]interface{}{"error": err.Error()})
+		return
+	}
+	service.RemoveIdentity(uint32(id))
+	ctx.SetStatusCode(200)
+}
+
+// stream serves the websocket stream of a client.
+func (s *WebServer) stream(ctx *iris.Context) {
+	if err := udpService.AcceptWebSocket(ctx.ResponseWriter, ctx.Request); err != nil {
+		log.Info("Refuse stream from %s. %s", ctx.RemoteAddr(), err.Error())
+	}
+}
+
 func (s *WebServer) connect(ctx *iris.Context) {
+	if !its.ItsManager.IsActive() {
+		ctx.JSON(iris.StatusConflict, map[string]interface{}{"error": "Not the leading center."})
+		return
+	}
 	its.ItsManager.Connect()
 	ctx.SetStatusCode(200)
 }
\ No newline at end of file
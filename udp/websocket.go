@@ -0,0 +1,178 @@
+package udp
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// StreamPath is where the web server of a center accepts websocket streams.
+const StreamPath = "/stream"
+
+// websocketGuid is appended to the key of a websocket handshake, RFC 6455.
+const websocketGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes of the websocket frames streams use. Each package is sent as one
+// binary message in a single frame.
+const (
+	websocketBinary = 0x2
+	websocketClose  = 0x8
+	websocketPing   = 0x9
+	websocketPong   = 0xA
+)
+
+func websocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + websocketGuid))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+// headerContains tells if the comma separated header has token.
+func headerContains(header string, token string) bool {
+	for _, v := range strings.Split(header, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket answers the websocket handshake of r and takes over its
+// connection.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (net.Conn, *bufio.Reader, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerContains(r.Header.Get("Connection"), "upgrade") ||
+		!headerContains(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		http.Error(w, "Not a websocket handshake.", http.StatusBadRequest)
+		return nil, nil, errors.New("Not a websocket handshake.")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Can't take over connection.", http.StatusInternalServerError)
+		return nil, nil, errors.New("Can't take over connection.")
+	}
+	connection, buffer, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	connection.SetWriteDeadline(time.Now().Add(StreamTimeout))
+	_, err = connection.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"))
+	if err != nil {
+		connection.Close()
+		return nil, nil, err
+	}
+	return connection, buffer.Reader, nil
+}
+
+// dialWebSocket connects to StreamPath of the web server at address.
+func dialWebSocket(network string, address string) (net.Conn, *bufio.Reader, error) {
+	connection, err := net.DialTimeout(network, address, StreamTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	connection.SetDeadline(time.Now().Add(StreamTimeout))
+	request, _ := http.NewRequest(http.MethodGet, "http://"+address+StreamPath, nil)
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Sec-WebSocket-Key", key)
+	request.Header.Set("Sec-WebSocket-Version", "13")
+	if err := request.Write(connection); err != nil {
+		connection.Close()
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(connection)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		connection.Close()
+		return nil, nil, err
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols || response.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		connection.Close()
+		return nil, nil, errors.New("Websocket handshake refused.")
+	}
+	connection.SetDeadline(time.Time{})
+	return connection, reader, nil
+}
+
+// websocketFrame builds a final frame of opcode. Clients mask their frames.
+func websocketFrame(opcode byte, data []byte, mask bool) []byte {
+	frame := make([]byte, 0, 8+len(data))
+	frame = append(frame, 0x80|opcode)
+	maskBit := byte(0)
+	if mask {
+		maskBit = 0x80
+	}
+	if len(data) < 126 {
+		frame = append(frame, maskBit|byte(len(data)))
+	} else {
+		frame = append(frame, maskBit|126, byte(len(data)>>8), byte(len(data)))
+	}
+	if !mask {
+		return append(frame, data...)
+	}
+	key := make([]byte, 4)
+	rand.Read(key)
+	frame = append(frame, key...)
+	start := len(frame)
+	frame = append(frame, data...)
+	for i := range data {
+		frame[start+i] ^= key[i%4]
+	}
+	return frame
+}
+
+// readWebSocketFrame reads one frame into buffer. Frames of the client must
+// be masked, those of the server must not.
+func readWebSocketFrame(reader *bufio.Reader, buffer []byte, fromClient bool) (byte, int, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, 0, err
+	}
+	opcode := header[0] & 0x0F
+	if header[0]&0x80 == 0 || header[0]&0x70 != 0 {
+		return 0, 0, errors.New("Unsupported websocket frame.")
+	}
+	if (header[1]&0x80 != 0) != fromClient {
+		return 0, 0, errors.New("Wrong websocket mask.")
+	}
+	n := int(header[1] & 0x7F)
+	if n == 127 {
+		return 0, 0, errors.New("Wrong frame size.")
+	}
+	if n == 126 {
+		length := make([]byte, 2)
+		if _, err := io.ReadFull(reader, length); err != nil {
+			return 0, 0, err
+		}
+		n = int(binary.BigEndian.Uint16(length))
+	}
+	if n > len(buffer) || opcode >= websocketClose && n > 125 {
+		return 0, 0, errors.New("Wrong frame size.")
+	}
+	key := make([]byte, 4)
+	if fromClient {
+		if _, err := io.ReadFull(reader, key); err != nil {
+			return 0, 0, err
+		}
+	}
+	if _, err := io.ReadFull(reader, buffer[:n]); err != nil {
+		return 0, 0, err
+	}
+	if fromClient {
+		for i := 0; i < n; i++ {
+			buffer[i] ^= key[i%4]
+		}
+	}
+	return opcode, n, nil
+}